@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"cas-to-oauth2/config"
@@ -21,17 +26,13 @@ func main() {
 
 	r.LoadHTMLGlob("web/templates/*")
 	config.LoadConfig()
-	database.Connect(config.AppConfig.DBUser,
-		config.AppConfig.DBPassword,
-		config.AppConfig.DBURI,
-		config.AppConfig.DBDatabase,
-		config.AppConfig.DBPoolSize)
+	openTicketRegistry()
 
 	checker := health.NewChecker(
 		health.WithCheck(health.Check{
-			Name: "mongodb",
+			Name: "ticket-registry",
 			Check: func(ctx context.Context) error {
-				return database.Conn.Client().Ping(ctx, nil)
+				return database.Registry.Ping(ctx)
 			},
 			Timeout: time.Second * 5,
 		}),
@@ -41,8 +42,15 @@ func main() {
 	r.GET(constants.ENDPOINT_LOGIN, handlers.Login)
 	r.POST(constants.ENDPOINT_LOGIN, handlers.Login)
 	r.GET(constants.ENDPOINT_OAUTH2, handlers.OAuth2Callback)
+	r.GET(constants.ENDPOINT_OAUTH2_PROVIDER, handlers.OAuth2Callback)
+	r.POST(constants.ENDPOINT_OAUTH2, handlers.OAuth2Callback)
+	r.POST(constants.ENDPOINT_OAUTH2_PROVIDER, handlers.OAuth2Callback)
+	r.POST(constants.ENDPOINT_BACKCHANNEL_LOGOUT, handlers.BackchannelLogout)
+	r.POST(constants.ENDPOINT_BACKCHANNEL_LOGOUT_PROVIDER, handlers.BackchannelLogout)
 	r.GET(constants.ENDPOINT_SERVICE_VALIDATE, handlers.ServiceValidate)
-	r.GET(constants.ENDPOINT_PROXY_VALIDATE, handlers.ServiceValidate)
+	r.GET(constants.ENDPOINT_PROXY_VALIDATE, handlers.ProxyValidate)
+	r.GET(constants.ENDPOINT_P3_SERVICE_VALIDATE, handlers.P3ServiceValidate)
+	r.GET(constants.ENDPOINT_P3_PROXY_VALIDATE, handlers.P3ProxyValidate)
 	r.POST(constants.ENDPOINT_SAML_VALIDATE, handlers.SamlValidate)
 	r.GET(constants.ENDPOINT_VALIDATE, handlers.Validate)
 	r.GET(constants.ENDPOINT_PROXY, handlers.Proxy)
@@ -50,7 +58,67 @@ func main() {
 	r.POST(constants.ENDPOINT_LOGOUT, handlers.Logout)
 	r.GET(constants.ENDPOINT_HEALTHCHECK, gin.WrapF(health.NewHandler(checker)))
 
-	if err := r.Run(":8080"); err != nil {
-		log.Fatal(constants.MAIN_ERRMSG, err)
+	server := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(constants.MAIN_ERRMSG, err)
+		}
+	}()
+
+	waitForShutdown(server)
+}
+
+// shutdownTimeout bounds the time given to the requests in progress, and then to the ticket registry, on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then stops accepting requests, lets the ones in progress
+// finish and closes the ticket registry, so the memory registry saves its snapshot.
+func waitForShutdown(server *http.Server) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf(constants.MAIN_ERRMSG_SHUTDOWN, err)
+	}
+
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelClose()
+	if err := database.Registry.Close(closeCtx); err != nil {
+		log.Printf(constants.MAIN_ERRMSG_CLOSE, err)
+	}
+}
+
+// openTicketRegistry opens the ticket registry selected by TICKET_REGISTRY.
+func openTicketRegistry() {
+	switch config.AppConfig.TicketRegistry {
+	case constants.DB_REGISTRY_MONGODB:
+		database.Connect(config.AppConfig.DBUser,
+			config.AppConfig.DBPassword,
+			config.AppConfig.DBURI,
+			config.AppConfig.DBDatabase,
+			config.AppConfig.DBPoolSize)
+	case constants.DB_REGISTRY_MEMORY:
+		database.OpenMemory(config.AppConfig.SnapshotFile,
+			time.Duration(config.AppConfig.SweepInterval)*time.Second)
+	case constants.DB_REGISTRY_REDIS:
+		database.OpenRedis(config.AppConfig.RedisAddrs,
+			config.AppConfig.RedisMaster,
+			config.AppConfig.RedisUser,
+			config.AppConfig.RedisPassword,
+			config.AppConfig.RedisDB,
+			config.AppConfig.RedisTLS,
+			config.AppConfig.RedisPrefix)
+	case constants.DB_REGISTRY_POSTGRES:
+		database.OpenSQL("postgres", config.AppConfig.SQLDSN,
+			time.Duration(config.AppConfig.SQLCleanup)*time.Second)
+	case constants.DB_REGISTRY_SQLITE:
+		database.OpenSQL("sqlite3", config.AppConfig.SQLDSN,
+			time.Duration(config.AppConfig.SQLCleanup)*time.Second)
+	default:
+		log.Fatalf(constants.MAIN_ERRMSG_REGISTRY, config.AppConfig.TicketRegistry)
 	}
 }
@@ -3,9 +3,12 @@ package config
 import (
 	"cas-to-oauth2/constants"
 	"cas-to-oauth2/internal/auth"
+	"cas-to-oauth2/internal/utils"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/joho/godotenv"
@@ -21,6 +24,18 @@ type Config struct {
 	DBPassword     string
 	DBDatabase     string
 	DBPoolSize     int
+	TicketRegistry string
+	SnapshotFile   string
+	SweepInterval  int
+	RedisAddrs     []string
+	RedisMaster    string
+	RedisUser      string
+	RedisPassword  string
+	RedisDB        int
+	RedisTLS       bool
+	RedisPrefix    string
+	SQLDSN         string
+	SQLCleanup     int
 	TGTName        string
 	TGTDuration    int
 	Domain         string
@@ -31,12 +46,22 @@ type Config struct {
 	TGTSecure      bool
 	TGTHttpOnly    bool
 	SecureCookie   *securecookie.SecureCookie
+	TokenCipher    *securecookie.SecureCookie
 	Rules          string
+
+	RefreshInterval int
+
+	LoginMode        string
+	FormLoginDomains []string
+
+	HomeRealmRules map[string]string
+
+	PrincipalResolver *auth.PrincipalResolver
 }
 
 var (
-	AppConfig    Config
-	AuthProvider auth.Authenticator
+	AppConfig Config
+	Providers []*Provider
 )
 
 func LoadConfig() {
@@ -55,6 +80,24 @@ func LoadConfig() {
 	AppConfig.DBPassword = viper.GetString("DB_PASSWORD")
 	AppConfig.DBDatabase = viper.GetString("DB_DATABASE")
 	AppConfig.DBPoolSize, _ = strconv.Atoi(viper.GetString("DB_POOL_SIZE"))
+	AppConfig.TicketRegistry = viper.GetString("TICKET_REGISTRY")
+	if AppConfig.TicketRegistry == "" {
+		AppConfig.TicketRegistry = constants.DB_REGISTRY_MONGODB
+	}
+	AppConfig.SnapshotFile = viper.GetString("MEMORY_SNAPSHOT_FILE")
+	AppConfig.SweepInterval = getInt("MEMORY_SWEEP_INTERVAL", 60)
+	AppConfig.RedisAddrs = getList("REDIS_ADDRS", "localhost:6379")
+	AppConfig.RedisMaster = viper.GetString("REDIS_MASTER_NAME")
+	AppConfig.RedisUser = viper.GetString("REDIS_USERNAME")
+	AppConfig.RedisPassword = viper.GetString("REDIS_PASSWORD")
+	AppConfig.RedisDB = getInt("REDIS_DB", 0)
+	AppConfig.RedisTLS, _ = strconv.ParseBool(viper.GetString("REDIS_TLS"))
+	AppConfig.RedisPrefix = viper.GetString("REDIS_KEY_PREFIX")
+	if AppConfig.RedisPrefix == "" {
+		AppConfig.RedisPrefix = "cas:"
+	}
+	AppConfig.SQLDSN = viper.GetString("SQL_DSN")
+	AppConfig.SQLCleanup = getInt("SQL_CLEANUP_INTERVAL", 60)
 	AppConfig.TGTName = viper.GetString("TGT_NAME")
 	AppConfig.TGTDuration, _ = strconv.Atoi(viper.GetString("TGT_DURATION"))
 	AppConfig.Domain = viper.GetString("DOMAIN_SCOPE")
@@ -67,28 +110,264 @@ func LoadConfig() {
 	AppConfig.Rules = viper.GetString("RULES")
 
 	// SecureCookie is used to encrypt and decrypt the service URL
-	hashKey := []byte(viper.GetString("SC_HASH_KEY"))
-	blockKey := []byte(viper.GetString("SC_BLOCK_KEY"))
+	hashKey := requireKey("SC_HASH_KEY", 32, 64)
+	blockKey := requireKey("SC_BLOCK_KEY", 16, 24, 32)
 	AppConfig.SecureCookie = securecookie.New(hashKey, blockKey)
 
+	// TokenCipher encrypts the upstream refresh tokens stored with the TGTs, which live longer than a cookie
+	tokenCipher, err := utils.NewTokenCipher(hashKey, blockKey)
+	if err != nil {
+		log.Fatalf("Error deriving the refresh token keys: %v", err)
+	}
+	AppConfig.TokenCipher = tokenCipher
+	AppConfig.RefreshInterval, _ = strconv.Atoi(viper.GetString("REFRESH_INTERVAL"))
+	AppConfig.LoginMode = viper.GetString("LOGIN_MODE")
+	AppConfig.FormLoginDomains = getList("FORM_LOGIN_DOMAINS", "")
+
+	principalResolver, err := auth.NewPrincipalResolver(
+		getList("PRINCIPAL_CLAIMS", constants.AUTH_DEFAULT_PRINCIPAL_CLAIM),
+		getList("PRINCIPAL_TRANSFORMS", ""),
+		viper.GetString("PRINCIPAL_REGEX"),
+		viper.GetString("PRINCIPAL_REGEX_REPLACEMENT"))
+	if err != nil {
+		log.Fatalf("Invalid principal configuration: %v", err)
+	}
+	AppConfig.PrincipalResolver = principalResolver
+
 	if AppConfig.AuthMethod == constants.OAUTH_METHOD {
-		AuthProvider = initOAuth2Provider()
+		Providers = initProviders()
+		AppConfig.HomeRealmRules = initHomeRealmRules()
 	} else {
 		log.Fatal("Auth method not supported")
 	}
 }
 
-func initOAuth2Provider() auth.Authenticator {
+// initOAuth2Provider reads the settings of one OAuth2 provider, all of them named with the given prefix.
+func initOAuth2Provider(prefix string) auth.Authenticator {
+	clientID := viper.GetString(prefix + "CLIENT_ID")
 	oauth2Config := oauth2.Config{
-		ClientID:     viper.GetString("OAUTH2_CLIENT_ID"),
-		ClientSecret: viper.GetString("OAUTH2_CLIENT_SECRET"),
-		RedirectURL:  viper.GetString("OAUTH2_REDIRECT_URL"),
-		Scopes:       []string{"openid", "profile", "email"},
+		ClientID:     clientID,
+		ClientSecret: viper.GetString(prefix + "CLIENT_SECRET"),
+		RedirectURL:  viper.GetString(prefix + "REDIRECT_URL"),
+		Scopes:       getList(prefix+"SCOPES", constants.AUTH_DEFAULT_SCOPES),
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  viper.GetString("OAUTH2_AUTH_URL"),
-			TokenURL: viper.GetString("OAUTH2_TOKEN_URL"),
+			AuthURL:  viper.GetString(prefix + "AUTH_URL"),
+			TokenURL: viper.GetString(prefix + "TOKEN_URL"),
 		},
 	}
 
-	return auth.NewOAuth2Authenticator(oauth2Config)
+	httpClient, breaker := initHTTPClient(prefix, &oauth2Config)
+
+	if strings.ToLower(viper.GetString(prefix+"TYPE")) == constants.AUTH_TYPE_OAUTH2 {
+		return initProfileProvider(prefix, oauth2Config, httpClient, breaker)
+	}
+
+	// Endpoints are read from the discovery document unless they are all set by hand
+	issuer := requireString(prefix + "ISSUER")
+	useDiscovery := oauth2Config.Endpoint.AuthURL == "" || oauth2Config.Endpoint.TokenURL == ""
+
+	keys := auth.NewKeySet(viper.GetString(prefix + "JWKS_URL"))
+	keys.Client = httpClient
+	algorithms := getList(prefix+"SIGNING_ALGS", constants.AUTH_DEFAULT_SIGNING_ALG)
+	clockSkew, _ := strconv.Atoi(viper.GetString(prefix + "CLOCK_SKEW"))
+	verifier := auth.NewIDTokenVerifier(issuer, clientID, algorithms, time.Duration(clockSkew)*time.Second, keys)
+
+	authenticator := auth.NewOAuth2Authenticator(oauth2Config, verifier)
+	authenticator.UsePKCE, _ = strconv.ParseBool(viper.GetString(prefix + "USE_PKCE"))
+	authenticator.ResponseMode = viper.GetString(prefix + "RESPONSE_MODE")
+	authenticator.HTTPClient = httpClient
+	authenticator.Breaker = breaker
+	initAuthorizationRequest(prefix, authenticator, issuer)
+	authenticator.UserInfoURL = viper.GetString(prefix + "USERINFO_URL")
+	authenticator.FetchUserInfo, _ = strconv.ParseBool(viper.GetString(prefix + "USERINFO"))
+	authenticator.PreferUserInfo = viper.GetString(prefix+"USERINFO_PRECEDENCE") == constants.AUTH_USERINFO_PREFERRED
+	authenticator.EndSessionURL = viper.GetString(prefix + "END_SESSION_URL")
+	authenticator.UpstreamLogout, _ = strconv.ParseBool(viper.GetString(prefix + "UPSTREAM_LOGOUT"))
+	authenticator.PostLogoutRedirectURL = viper.GetString(prefix + "POST_LOGOUT_REDIRECT_URL")
+
+	if useDiscovery {
+		if err := authenticator.Discover(issuer); err != nil {
+			log.Fatalf("Error reading OIDC discovery document of %s: %v", issuer, err)
+		}
+
+		// The provider may still accept them, some do not list every scope they support
+		if unsupported := authenticator.Metadata.UnsupportedScopes(oauth2Config.Scopes); len(unsupported) > 0 {
+			log.Printf("Scopes %v of %sSCOPES are not in the scopes_supported of %s", unsupported, prefix, issuer)
+		}
+
+		refreshMinutes, _ := strconv.Atoi(viper.GetString(prefix + "DISCOVERY_REFRESH"))
+		if refreshMinutes <= 0 {
+			refreshMinutes = 60
+		}
+		go authenticator.WatchDiscovery(issuer, time.Duration(refreshMinutes)*time.Minute)
+	} else {
+		requireString(prefix + "JWKS_URL")
+	}
+
+	if authenticator.UsePAR && authenticator.PARURL == "" {
+		log.Fatalf(constants.AUTH_ERRMSG_CONFIG_MISSING, prefix+"PAR_URL")
+	}
+
+	return authenticator
+}
+
+// initProfileProvider reads the settings of a plain OAuth2 provider, which has no discovery document
+// nor ID token, so the endpoints are required and the user is read from its profile API.
+func initProfileProvider(prefix string, oauth2Config oauth2.Config, httpClient *http.Client, breaker *auth.CircuitBreaker) auth.Authenticator {
+	requireString(prefix + "AUTH_URL")
+	requireString(prefix + "TOKEN_URL")
+
+	// The OpenID Connect scopes are not a sensible default for plain OAuth2
+	oauth2Config.Scopes = getList(prefix+"SCOPES", "")
+
+	subjectPath := viper.GetString(prefix + "PROFILE_SUBJECT")
+	if subjectPath == "" {
+		subjectPath = constants.AUTH_DEFAULT_PROFILE_SUBJECT
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range getList(prefix+"PROFILE_ATTRIBUTES", "") {
+		name, path, found := strings.Cut(attribute, "=")
+		if !found {
+			path = name
+		}
+		attributes[strings.TrimSpace(name)] = strings.TrimSpace(path)
+	}
+
+	authenticator := auth.NewProfileAuthenticator(oauth2Config, requireString(prefix+"PROFILE_URL"), subjectPath, attributes)
+	authenticator.UsePKCE, _ = strconv.ParseBool(viper.GetString(prefix + "USE_PKCE"))
+	authenticator.ResponseMode = viper.GetString(prefix + "RESPONSE_MODE")
+	authenticator.HTTPClient = httpClient
+	authenticator.Breaker = breaker
+
+	audience := viper.GetString(prefix + "ISSUER")
+	if audience == "" {
+		audience = oauth2Config.Endpoint.AuthURL
+	}
+	initAuthorizationRequest(prefix, authenticator.OAuth2Authenticator, audience)
+	if authenticator.UsePAR && authenticator.PARURL == "" {
+		log.Fatalf(constants.AUTH_ERRMSG_CONFIG_MISSING, prefix+"PAR_URL")
+	}
+
+	return authenticator
+}
+
+// initAuthorizationRequest enables the pushed authorization requests and the signed request objects.
+// Request objects are signed with the private_key_jwt key unless another one is configured.
+func initAuthorizationRequest(prefix string, authenticator *auth.OAuth2Authenticator, audience string) {
+	authenticator.UsePAR, _ = strconv.ParseBool(viper.GetString(prefix + "USE_PAR"))
+	authenticator.PARURL = viper.GetString(prefix + "PAR_URL")
+
+	if useRequestObject, _ := strconv.ParseBool(viper.GetString(prefix + "REQUEST_OBJECT")); !useRequestObject {
+		return
+	}
+
+	keyFile := viper.GetString(prefix + "REQUEST_KEY_FILE")
+	keyID := viper.GetString(prefix + "REQUEST_KEY_ID")
+	if keyFile == "" {
+		keyFile = requireString(prefix + "CLIENT_KEY_FILE")
+		keyID = viper.GetString(prefix + "CLIENT_KEY_ID")
+	}
+
+	signer, err := auth.NewKeySigner(keyFile, keyID)
+	if err != nil {
+		log.Fatalf("Error reading request object key: %v", err)
+	}
+	authenticator.RequestSigner = signer
+	authenticator.RequestAudience = audience
+}
+
+// initHTTPClient builds the client of every request to the provider: token, PAR, UserInfo, JWKS and discovery.
+// The HTTP_ settings are shared, but every provider has its own client so one provider down does not
+// open the circuit of the others.
+func initHTTPClient(prefix string, oauth2Config *oauth2.Config) (*http.Client, *auth.CircuitBreaker) {
+	timeout := time.Duration(getInt("HTTP_TIMEOUT", 10)) * time.Second
+	transport, err := auth.NewTransport(viper.GetString("HTTP_CA_FILE"), viper.GetString("HTTP_PROXY_URL"), timeout)
+	if err != nil {
+		log.Fatalf("Error configuring the HTTP client: %v", err)
+	}
+
+	retries := &auth.RetryTransport{
+		Base:    initClientAuth(prefix, oauth2Config, transport),
+		Retries: getInt("HTTP_RETRIES", 2),
+		Backoff: 200 * time.Millisecond,
+	}
+	breaker := &auth.CircuitBreaker{
+		Base:        retries,
+		MaxFailures: getInt("HTTP_BREAKER_FAILURES", 5),
+		OpenTimeout: time.Duration(getInt("HTTP_BREAKER_TIMEOUT", 30)) * time.Second,
+	}
+
+	// Every attempt has the whole timeout, plus the waits between them
+	clientTimeout := timeout*time.Duration(retries.Retries+1) + retries.TotalBackoff()
+	return &http.Client{Transport: breaker, Timeout: clientTimeout}, breaker
+}
+
+// initClientAuth configures how the client authenticates to the token endpoint. With private_key_jwt and
+// tls_client_auth there is no client secret, the client ID is sent in the body and the returned transport
+// adds a signed assertion or presents a certificate.
+func initClientAuth(prefix string, oauth2Config *oauth2.Config, transport *http.Transport) http.RoundTripper {
+	method := viper.GetString(prefix + "CLIENT_AUTH")
+	switch method {
+	case "", constants.AUTH_CLIENT_AUTH_SECRET:
+		return transport
+	case constants.AUTH_CLIENT_AUTH_PRIVATE_KEY_JWT:
+		signer, err := auth.NewKeySigner(requireString(prefix+"CLIENT_KEY_FILE"), viper.GetString(prefix+"CLIENT_KEY_ID"))
+		if err != nil {
+			log.Fatalf("Error reading client key: %v", err)
+		}
+		oauth2Config.ClientSecret = ""
+		oauth2Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+		return &auth.ClientAssertionTransport{Base: transport, ClientID: oauth2Config.ClientID, Signer: signer}
+	case constants.AUTH_CLIENT_AUTH_TLS:
+		err := auth.AddClientCertificate(transport, requireString(prefix+"CLIENT_CERT_FILE"), requireString(prefix+"CLIENT_CERT_KEY_FILE"))
+		if err != nil {
+			log.Fatalf("Error reading client certificate: %v", err)
+		}
+		oauth2Config.ClientSecret = ""
+		oauth2Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+		return transport
+	default:
+		log.Fatalf(constants.AUTH_ERRMSG_CLIENT_AUTH, method)
+		return nil
+	}
+}
+
+func getInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(viper.GetString(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getList(key, defaultValue string) []string {
+	value := viper.GetString(key)
+	if value == "" {
+		value = defaultValue
+	}
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func requireString(key string) string {
+	value := viper.GetString(key)
+	if value == "" {
+		log.Fatalf(constants.AUTH_ERRMSG_CONFIG_MISSING, key)
+	}
+	return value
+}
+
+// requireKey reads a secret key, which must have one of the given lengths in bytes.
+func requireKey(key string, lengths ...int) []byte {
+	value := []byte(viper.GetString(key))
+	for _, length := range lengths {
+		if len(value) == length {
+			return value
+		}
+	}
+	log.Fatalf(constants.AUTH_ERRMSG_KEY_LENGTH, key, lengths, len(value))
+	return nil
 }
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/internal/auth"
+	"log"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Provider is one of the upstream identity providers users can log in with.
+// ServiceDomains lists the services whose users always log in with this provider.
+type Provider struct {
+	Name           string
+	Label          string
+	ServiceDomains []string
+	Authenticator  auth.Authenticator
+}
+
+// initProviders reads the providers listed in OAUTH2_PROVIDERS, each one configured with the
+// OAUTH2_<NAME>_ variables. Without the list a single provider is read from the OAUTH2_ variables.
+func initProviders() []*Provider {
+	names := getList("OAUTH2_PROVIDERS", "")
+	if len(names) == 0 {
+		return []*Provider{{
+			Name:          constants.AUTH_DEFAULT_PROVIDER,
+			Label:         constants.AUTH_DEFAULT_PROVIDER,
+			Authenticator: initOAuth2Provider(constants.AUTH_PROVIDER_PREFIX),
+		}}
+	}
+
+	var providers []*Provider
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || providerIndex(providers, name) >= 0 {
+			log.Fatalf(constants.AUTH_ERRMSG_PROVIDER_NAME, name)
+		}
+
+		prefix := constants.AUTH_PROVIDER_PREFIX + strings.ToUpper(name) + "_"
+		label := viper.GetString(prefix + "LABEL")
+		if label == "" {
+			label = name
+		}
+
+		providers = append(providers, &Provider{
+			Name:           name,
+			Label:          label,
+			ServiceDomains: getList(prefix+"SERVICE_DOMAINS", ""),
+			Authenticator:  initOAuth2Provider(prefix),
+		})
+	}
+
+	return providers
+}
+
+// GetProvider returns the provider with the given name, or nil when it is not configured.
+// An empty name is the first provider, which TGTs created before providers had names belong to.
+func GetProvider(name string) *Provider {
+	if name == "" && len(Providers) > 0 {
+		return Providers[0]
+	}
+
+	if i := providerIndex(Providers, name); i >= 0 {
+		return Providers[i]
+	}
+	return nil
+}
+
+func providerIndex(providers []*Provider, name string) int {
+	for i, provider := range providers {
+		if provider.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// initHomeRealmRules reads HOME_REALM_RULES, a list of domain=provider pairs used to pick the provider
+// from the email the user types. The * domain matches hints without a domain or with an unknown one.
+func initHomeRealmRules() map[string]string {
+	rules := map[string]string{}
+	for _, rule := range getList("HOME_REALM_RULES", "") {
+		domain, name, found := strings.Cut(rule, "=")
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !found || domain == "" || name == "" || GetProvider(name) == nil {
+			log.Fatalf(constants.AUTH_ERRMSG_HOME_REALM_RULE, rule)
+		}
+		rules[domain] = name
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+	return rules
+}
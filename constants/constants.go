@@ -2,25 +2,49 @@ package constants
 
 const (
 	// Endpoints
-	ENDPOINT_ROOT             = "/"
-	ENDPOINT_LOGIN            = "/login"
-	ENDPOINT_OAUTH2           = "/oauth2/callback"
-	ENDPOINT_SERVICE_VALIDATE = "/serviceValidate"
-	ENDPOINT_PROXY_VALIDATE   = "/proxyValidate"
-	ENDPOINT_SAML_VALIDATE    = "/samlValidate"
-	ENDPOINT_VALIDATE         = "/validate"
-	ENDPOINT_PROXY            = "/proxy"
-	ENDPOINT_LOGOUT           = "/logout"
-	ENDPOINT_HEALTHCHECK      = "/healthcheck"
+	ENDPOINT_ROOT                        = "/"
+	ENDPOINT_LOGIN                       = "/login"
+	ENDPOINT_OAUTH2                      = "/oauth2/callback"
+	ENDPOINT_BACKCHANNEL_LOGOUT          = "/oauth2/backchannel-logout"
+	ENDPOINT_OAUTH2_PROVIDER             = "/oauth2/callback/:provider"
+	ENDPOINT_BACKCHANNEL_LOGOUT_PROVIDER = "/oauth2/backchannel-logout/:provider"
+	ENDPOINT_SERVICE_VALIDATE            = "/serviceValidate"
+	ENDPOINT_PROXY_VALIDATE              = "/proxyValidate"
+	ENDPOINT_P3_SERVICE_VALIDATE         = "/p3/serviceValidate"
+	ENDPOINT_P3_PROXY_VALIDATE           = "/p3/proxyValidate"
+	ENDPOINT_SAML_VALIDATE               = "/samlValidate"
+	ENDPOINT_VALIDATE                    = "/validate"
+	ENDPOINT_PROXY                       = "/proxy"
+	ENDPOINT_LOGOUT                      = "/logout"
+	ENDPOINT_HEALTHCHECK                 = "/healthcheck"
 
 	// Template variables
-	TEMPLATE_MESSAGE = "message"
+	TEMPLATE_MESSAGE   = "message"
+	TEMPLATE_ACTION    = "action"
+	TEMPLATE_SERVICE   = "service"
+	TEMPLATE_RENEW     = "renew"
+	TEMPLATE_CSRF      = "csrf"
+	TEMPLATE_PROVIDER  = "provider"
+	TEMPLATE_PROVIDERS = "providers"
+	TEMPLATE_DISCOVERY = "discovery"
+	TEMPLATE_GATEWAY   = "gateway"
+	TEMPLATE_USERNAME  = "username"
 
 	// Cookies
-	SERVICE_URL_COOKIE = "serviceURL"
+	SERVICE_URL_COOKIE  = "serviceURL"
+	AUTH_REQUEST_COOKIE = "authRequest"
+	REFRESH_TOKEN_NAME  = "refreshToken"
+	LOGIN_CSRF_COOKIE   = "loginCSRF"
+
+	// Key derivation labels
+	TOKEN_CIPHER_HASH_LABEL  = "cas-to-oauth2 refresh token hash key"
+	TOKEN_CIPHER_BLOCK_LABEL = "cas-to-oauth2 refresh token block key"
 
 	// Main
-	MAIN_ERRMSG = "Error starting server"
+	MAIN_ERRMSG          = "Error starting server"
+	MAIN_ERRMSG_REGISTRY = "Unknown ticket registry %q"
+	MAIN_ERRMSG_SHUTDOWN = "Error shutting down server: %v"
+	MAIN_ERRMSG_CLOSE    = "Error closing ticket registry: %v"
 
 	// Common
 	COMMON_SERVICE_PARAM          = "service"
@@ -29,58 +53,185 @@ const (
 	COMMON_ERRMSG_MISSING         = "Ticket Granting Ticket is missing"
 	COMMON_ERRMSG_URL_PARSE       = "Error parsing URL"
 	COMMON_ERRMSG_INVALID_SERVICE = "Service access is not allowed"
+	COMMON_ERRMSG_REGISTRY        = "Sessions are temporarily unavailable, please try again later"
 
 	// OAuth2Callback
-	OAUTH_METHOD               = "oauth2"
-	OAUTH_CODE_PARAM           = "code"
-	OAUTH_ERRMSG_UNAUTHORIZED  = "Authorization code missing"
-	OAUTH_ERRMSG_INVALID_TOKEN = "Invalid token"
-	OAUTH_ERRMSG_EXCHANGE      = "Error exchanging code for token"
-	OAUTH_ERRMSG_SUB           = "Error getting subject from token"
-	OAUTH_ERRMSG_OK            = "TGT successfully generated"
-	OAUTH_ERRMSG_SPAN          = "Return from OAuth2 provider"
+	OAUTH_METHOD                           = "oauth2"
+	OAUTH_CODE_PARAM                       = "code"
+	OAUTH_STATE_PARAM                      = "state"
+	OAUTH_ERROR_PARAM                      = "error"
+	OAUTH_ERROR_DESCRIPTION_PARAM          = "error_description"
+	OAUTH_ERROR_URI_PARAM                  = "error_uri"
+	OAUTH_ERROR_ACCESS_DENIED              = "access_denied"
+	OAUTH_ERROR_TEMPORARILY_UNAVAILABLE    = "temporarily_unavailable"
+	OAUTH_ERROR_SERVER_ERROR               = "server_error"
+	OAUTH_ERROR_LOGIN_REQUIRED             = "login_required"
+	OAUTH_ERROR_INTERACTION_REQUIRED       = "interaction_required"
+	OAUTH_ERROR_CONSENT_REQUIRED           = "consent_required"
+	OAUTH_ERROR_ACCOUNT_SELECTION_REQUIRED = "account_selection_required"
+	OAUTH_ERRMSG_STATE                     = "The login request is invalid or has expired, please try again"
+	OAUTH_ERRMSG_UNAUTHORIZED              = "Authorization code missing"
+	OAUTH_ERRMSG_INVALID_TOKEN             = "Invalid token"
+	OAUTH_ERRMSG_EXCHANGE                  = "Error exchanging code for token"
+	OAUTH_ERRMSG_SUB                       = "Error getting subject from token"
+	OAUTH_ERRMSG_VERIFY                    = "The identity provider response could not be verified"
+	OAUTH_ERRMSG_USERINFO                  = "Error getting user information from the identity provider"
+	OAUTH_ERRMSG_ACCESS_DENIED             = "Access was denied by the identity provider"
+	OAUTH_ERRMSG_LOGIN_REQUIRED            = "The identity provider requires you to log in again"
+	OAUTH_ERRMSG_UNAVAILABLE               = "The identity provider is temporarily unavailable, please try again later"
+	OAUTH_ERRMSG_PROVIDER                  = "The identity provider rejected the login request, please contact support"
+	OAUTH_ERRMSG_OK                        = "TGT successfully generated"
+	OAUTH_ERRMSG_SPAN                      = "Return from OAuth2 provider"
 
 	// ServiceValidate
 	VALIDATE_TICKET_PARAM           = "ticket"
 	VALIDATE_INVALID_REQUEST        = "INVALID_REQUEST"
 	VALIDATE_INVALID_TICKET         = "INVALID_TICKET"
+	VALIDATE_INTERNAL_ERROR         = "INTERNAL_ERROR"
 	VALIDATE_XML_RESPONSE           = "Error generating XML response"
 	VALIDATE_ERRMSG_INVALID_REQUEST = "Service Ticket or Service URL is missing"
 	VALIDATE_ERRMSG_INVALID_TICKET  = "Invalid Service Ticket"
+	VALIDATE_ERRMSG_INTERNAL_ERROR  = "An internal error occurred during ticket validation"
 	VALIDATE_IS_VALID               = "IsSTValid"
 	VALIDATE_IS_DIRECT              = "IsSTDirect"
+	VALIDATE_PGT_URL_PARAM          = "pgtUrl"
+	VALIDATE_PGT_ID_PARAM           = "pgtId"
+	VALIDATE_PGT_IOU_PARAM          = "pgtIou"
+	VALIDATE_ERRMSG_PGT_CALLBACK    = "Unexpected status %d from the proxy callback"
+	VALIDATE_PROXY_TICKET_PREFIX    = "PT-"
+
+	// Login form
+	LOGIN_MODE_FORM            = "form"
+	LOGIN_PROVIDER_PARAM       = "provider"
+	LOGIN_ERRMSG_PROVIDER      = "Unknown identity provider"
+	LOGIN_ERRMSG_HOME_REALM    = "No identity provider was found for that email, please choose one"
+	LOGIN_ERRMSG_MAINTENANCE   = "The identity provider is not responding, please try again in a few minutes"
+	LOGIN_USERNAME_PARAM       = "username"
+	LOGIN_PASSWORD_PARAM       = "password"
+	LOGIN_CSRF_PARAM           = "csrf_token"
+	LOGIN_ERRMSG_CSRF          = "The login form has expired, please try again"
+	LOGIN_ERRMSG_MISSING       = "Username and password are required"
+	LOGIN_ERRMSG_CREDENTIALS   = "Invalid username or password"
+	LOGIN_ERRMSG_FORM_DISABLED = "Login with username and password is not enabled for this service"
 
 	// Logout
-	LOGOUT_REDIRECT_PARAM    = "url"
-	LOGOUT_ERRMSG_MISSING    = "TGT Cookie is missing"
-	LOGOUT_ERRMSG_DELETE_TGT = "Error deleting TGT"
-	LOGOUT_OK                = "TGT successfully deleted"
-
-	// Utils
-	UTILS_ID_TOKEN               = "id_token"
-	UTILS_CLAIM                  = "sub"
-	UTILS_ERRMSG_MISSING         = "No id_token field in oauth2 token"
-	UTILS_ERRMSG_CLAIM_PARSE     = "Claims could not be parsed"
-	UTILS_ERRMSG_CLAIM_NOT_EXIST = "Claim does not exist"
+	LOGOUT_REDIRECT_PARAM     = "url"
+	LOGOUT_ERRMSG_MISSING     = "TGT Cookie is missing"
+	LOGOUT_ERRMSG_DELETE_TGT  = "Error deleting TGT"
+	LOGOUT_OK                 = "TGT successfully deleted"
+	LOGOUT_INVALID_REQUEST    = "invalid_request"
+	LOGOUT_ERRMSG_BACKCHANNEL = "Error deleting TGTs of the session"
+
+	// Auth
+	AUTH_ID_TOKEN                    = "id_token"
+	AUTH_NONCE_PARAM                 = "nonce"
+	AUTH_PROMPT_PARAM                = "prompt"
+	AUTH_PROMPT_LOGIN                = "login"
+	AUTH_PROMPT_NONE                 = "none"
+	AUTH_MAX_AGE_PARAM               = "max_age"
+	AUTH_AUTH_TIME_CLAIM             = "auth_time"
+	AUTH_EXPIRES_CLAIM               = "exp"
+	AUTH_ISSUER_CLAIM                = "iss"
+	AUTH_SUBJECT_CLAIM               = "sub"
+	AUTH_SESSION_ID_CLAIM            = "sid"
+	AUTH_EVENTS_CLAIM                = "events"
+	AUTH_BACKCHANNEL_LOGOUT_EVENT    = "http://schemas.openid.net/event/backchannel-logout"
+	AUTH_LOGOUT_TOKEN_PARAM          = "logout_token"
+	AUTH_ERROR_INVALID_GRANT         = "invalid_grant"
+	AUTH_CLIENT_ID_PARAM             = "client_id"
+	AUTH_ID_TOKEN_HINT_PARAM         = "id_token_hint"
+	AUTH_POST_LOGOUT_REDIRECT_PARAM  = "post_logout_redirect_uri"
+	AUTH_DEFAULT_SIGNING_ALG         = "RS256"
+	AUTH_ERRMSG_ID_TOKEN_MISSING     = "No id_token field in oauth2 token"
+	AUTH_ERRMSG_UNKNOWN_KEY          = "No signing key found for key ID %q"
+	AUTH_ERRMSG_KEY_ALG              = "Signing key does not allow algorithm %s"
+	AUTH_ERRMSG_KEY_TYPE             = "Unsupported key type %s"
+	AUTH_ERRMSG_JWKS_STATUS          = "Unexpected status %d fetching JWKS"
+	AUTH_ERRMSG_CLAIM_MISSING        = "Claim %s is missing"
+	AUTH_ERRMSG_CLAIM_INVALID        = "Claim %s is invalid"
+	AUTH_ERRMSG_CONFIG_MISSING       = "Missing required configuration %s"
+	AUTH_ERRMSG_KEY_LENGTH           = "%s must be one of %v bytes long, it has %d"
+	AUTH_DISCOVERY_PATH              = "/.well-known/openid-configuration"
+	AUTH_DEFAULT_SCOPES              = "openid,profile,email"
+	AUTH_ERRMSG_DISCOVERY_STATUS     = "Unexpected status %d fetching OIDC discovery document"
+	AUTH_ERRMSG_DISCOVERY_ISSUER     = "OIDC discovery document has unexpected issuer %q"
+	AUTH_ERRMSG_DISCOVERY_FIELD      = "OIDC discovery document is missing %s"
+	AUTH_ERRMSG_USERINFO_STATUS      = "Unexpected status %d fetching UserInfo"
+	AUTH_USERINFO_PREFERRED          = "userinfo"
+	AUTH_DEFAULT_PRINCIPAL_CLAIM     = "sub"
+	AUTH_ERRMSG_PRINCIPAL            = "None of the principal claims %v has a value"
+	AUTH_ERRMSG_PRINCIPAL_TRANSFORM  = "Unknown principal transformation %q"
+	AUTH_ERRMSG_LOGOUT_EVENT         = "Logout token does not contain the back-channel logout event"
+	AUTH_ERRMSG_LOGOUT_SUBJECT       = "Logout token must contain sub or sid"
+	AUTH_ERRMSG_LOGOUT_NONCE         = "Logout token must not contain a nonce"
+	AUTH_ERRMSG_LOGOUT_TYPE          = "Logout token has type %q instead of logout+jwt"
+	AUTH_ERRMSG_LOGOUT_REPLAYED      = "Logout token %s was already used"
+	AUTH_LOGOUT_TOKEN_TYPE           = "logout+jwt"
+	AUTH_TYPE_HEADER                 = "typ"
+	AUTH_JTI_CLAIM                   = "jti"
+	AUTH_DEFAULT_PROVIDER            = "default"
+	AUTH_PROVIDER_PREFIX             = "OAUTH2_"
+	AUTH_ERRMSG_PROVIDER_NAME        = "Provider name %q is empty or repeated in OAUTH2_PROVIDERS"
+	AUTH_ERRMSG_HOME_REALM_RULE      = "Invalid rule %q in HOME_REALM_RULES"
+	AUTH_HOME_REALM_DEFAULT          = "*"
+	AUTH_LOGIN_HINT_PARAM            = "login_hint"
+	AUTH_RESPONSE_MODE_PARAM         = "response_mode"
+	AUTH_RESPONSE_MODE_FORM_POST     = "form_post"
+	AUTH_CLIENT_SECRET_PARAM         = "client_secret"
+	AUTH_CLIENT_ASSERTION_PARAM      = "client_assertion"
+	AUTH_CLIENT_ASSERTION_TYPE_PARAM = "client_assertion_type"
+	AUTH_CLIENT_ASSERTION_TYPE_JWT   = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	AUTH_CLIENT_AUTH_SECRET          = "client_secret"
+	AUTH_CLIENT_AUTH_PRIVATE_KEY_JWT = "private_key_jwt"
+	AUTH_CLIENT_AUTH_TLS             = "tls_client_auth"
+	AUTH_ERRMSG_CLIENT_KEY           = "No supported private key found in %s"
+	AUTH_ERRMSG_CLIENT_AUTH          = "Unsupported client authentication method %q"
+	AUTH_RESPONSE_TYPE_PARAM         = "response_type"
+	AUTH_SCOPE_PARAM                 = "scope"
+	AUTH_REQUEST_PARAM               = "request"
+	AUTH_REQUEST_URI_PARAM           = "request_uri"
+	AUTH_ERRMSG_PAR_STATUS           = "Unexpected status %d pushing the authorization request"
+	AUTH_ERRMSG_CIRCUIT_OPEN         = "The identity provider is unavailable, requests are suspended"
+	AUTH_ERRMSG_CA_FILE              = "No certificates found in CA bundle %s"
+	AUTH_TYPE_OAUTH2                 = "oauth2"
+	AUTH_DEFAULT_PROFILE_SUBJECT     = "id"
+	AUTH_ERRMSG_PROFILE_STATUS       = "Unexpected status %d fetching the user profile"
+	AUTH_ERRMSG_LOGOUT_UNSUPPORTED   = "Back-channel logout is not supported by plain OAuth2 providers"
 
 	// Templates
 	UNAUTHORIZED_HTML = "unauthorized.html"
 	ERROR_HTML        = "error.html"
 	LOGIN_HTML        = "login.html"
 	LOGOUT_HTML       = "logout.html"
+	LOGIN_FORM_HTML   = "login_form.html"
+	PROVIDERS_HTML    = "providers.html"
+	MAINTENANCE_HTML  = "maintenance.html"
 
 	// CAS XML Namespaces
 	XML_CAS_NAMESPACE = "http://www.yale.edu/tp/cas"
+	XML_CAS_PREFIX    = "cas"
 
 	// Database Collections
 	DB_COLLECTION_SERVICE_TICKETS = "serviceTickets"
 	DB_COLLECTION_TGT             = "ticketGrantingTickets"
+	DB_COLLECTION_PGT             = "proxyGrantingTickets"
+	DB_COLLECTION_PROXY_TICKETS   = "proxyTickets"
+	DB_ERRMSG_NOT_FOUND           = "Ticket not found"
+	DB_ERRMSG_REGISTRY            = "%s ticket registry error: %v"
+
+	// Ticket Registries
+	DB_REGISTRY_MONGODB  = "mongodb"
+	DB_REGISTRY_MEMORY   = "memory"
+	DB_REGISTRY_REDIS    = "redis"
+	DB_REGISTRY_POSTGRES = "postgres"
+	DB_REGISTRY_SQLITE   = "sqlite"
 
 	// SAML Validate
 	SAML_TARGET_PARAM           = "TARGET"
 	SAML_ERRMSG_INVALID_REQUEST = "Invalid SAML Request"
 	SAML_ERRMSG_VALIDATION      = "Error in validation process"
 	SAML_ERRMSG_INVALID_TICKET  = "Invalid SAML Ticket or Service"
+	SAML_ERRMSG_INTERNAL        = "Internal error validating the ticket"
 	SAML_ISSUER                 = "cas-to-oauth2"
 	SAML_STATUSCODE_SUCCESS     = "saml1p:Success"
 	SAML_STATUSCODE_ERROR       = "saml1p:RequestDenied"
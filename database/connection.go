@@ -2,20 +2,22 @@ package database
 
 import (
 	"context"
+	"crypto/tls"
+	"database/sql"
 	"fmt"
 	"log"
+	"time"
 
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var ctx = context.TODO()
-var Conn *Client
-
-type Client struct {
-	*mongo.Database
-}
 
+// Connect opens the MongoDB ticket registry.
 func Connect(user, password, uri, db string, poolSize int) {
 	var err error
 	var client *mongo.Client
@@ -31,6 +33,65 @@ func Connect(user, password, uri, db string, poolSize int) {
 		log.Fatal(err)
 	}
 
-	Conn = &Client{client.Database(db)}
+	Registry = NewMongoRegistry(client.Database(db))
 	fmt.Println("Connected to MongoDB!")
 }
+
+// OpenMemory opens the in-memory ticket registry, restoring the snapshot file if there is one.
+func OpenMemory(snapshotFile string, sweepInterval time.Duration) {
+	registry, err := NewMemoryRegistry(snapshotFile, sweepInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Registry = registry
+	fmt.Println("Using the in-memory ticket registry")
+}
+
+// OpenRedis opens the Redis ticket registry. Several addresses select a cluster, unless a
+// Sentinel master name is given, in which case they are the Sentinel addresses.
+func OpenRedis(addrs []string, masterName, username, password string, db int, useTLS bool, prefix string) {
+	options := &redis.UniversalOptions{
+		Addrs:      addrs,
+		MasterName: masterName,
+		Username:   username,
+		Password:   password,
+		DB:         db,
+	}
+	if useTLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	client := redis.NewUniversalClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	Registry = NewRedisRegistry(client, prefix)
+	fmt.Println("Connected to Redis!")
+}
+
+// OpenSQL opens the SQL ticket registry with the postgres or sqlite3 driver and migrates its schema.
+func OpenSQL(driver, dsn string, cleanupInterval time.Duration) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SQLite allows one writer at a time, waiting for the connection is better than failing as busy
+	if driver == "sqlite3" {
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	registry, err := NewSQLRegistry(db, cleanupInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Registry = registry
+	fmt.Printf("Connected to %s!\n", driver)
+}
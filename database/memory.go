@@ -0,0 +1,408 @@
+package database
+
+import (
+	"cas-to-oauth2/constants"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MemoryRegistry keeps the tickets in memory, for development and single-node deployments.
+// Expired tickets are swept periodically. With a snapshot file, the TGTs and PGTs are saved on every
+// sweep and on Close, and loaded again at startup, so that users keep their sessions across restarts.
+type MemoryRegistry struct {
+	mutex          sync.RWMutex
+	tgts           map[string]*TicketGrantingTicket
+	serviceTickets map[string]*ServiceTicket
+	pgts           map[string]*ProxyGrantingTicket
+	proxyTickets   map[string]*ProxyTicket
+
+	snapshotFile string
+	stop         chan struct{}
+	stopped      sync.WaitGroup
+	closeOnce    sync.Once
+}
+
+// memorySnapshot is the content of the snapshot file. Service and proxy tickets live for
+// seconds, so they are not worth keeping.
+type memorySnapshot struct {
+	TGTs []*TicketGrantingTicket `json:"tgts"`
+	PGTs []*ProxyGrantingTicket  `json:"pgts"`
+}
+
+func NewMemoryRegistry(snapshotFile string, sweepInterval time.Duration) (*MemoryRegistry, error) {
+	r := &MemoryRegistry{
+		tgts:           make(map[string]*TicketGrantingTicket),
+		serviceTickets: make(map[string]*ServiceTicket),
+		pgts:           make(map[string]*ProxyGrantingTicket),
+		proxyTickets:   make(map[string]*ProxyTicket),
+		snapshotFile:   snapshotFile,
+		stop:           make(chan struct{}),
+	}
+
+	if err := r.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	if sweepInterval > 0 {
+		r.stopped.Add(1)
+		go r.sweepEvery(sweepInterval)
+	}
+
+	return r, nil
+}
+
+func (r *MemoryRegistry) CreateTGT(ticket *TicketGrantingTicket) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := *ticket
+	r.tgts[ticket.TGT] = &copied
+	return nil
+}
+
+func (r *MemoryRegistry) ValidateTGT(tgt string) (*TicketGrantingTicket, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ticket, found := r.tgts[tgt]
+	if !found || expired(ticket.Expires) {
+		return nil, ErrTicketNotFound
+	}
+
+	copied := *ticket
+	return &copied, nil
+}
+
+func (r *MemoryRegistry) UpdateTGTRefresh(tgt, refreshToken string, refreshedAt time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if ticket, found := r.tgts[tgt]; found {
+		updated := *ticket
+		updated.RefreshToken, updated.RefreshedAt = refreshToken, refreshedAt
+		r.tgts[tgt] = &updated
+	}
+	return nil
+}
+
+func (r *MemoryRegistry) DeleteTGT(tgt string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.tgts, tgt)
+	return nil
+}
+
+func (r *MemoryRegistry) DeleteTGTsBySession(provider, sub, sid string) (int64, error) {
+	if sub == "" && sid == "" {
+		return 0, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var deleted int64
+	for id, ticket := range r.tgts {
+		if ticket.Provider != provider || (sub != "" && ticket.Subject != sub) || (sid != "" && ticket.SessionID != sid) {
+			continue
+		}
+		delete(r.tgts, id)
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (r *MemoryRegistry) ListTGTs(username string) ([]*TicketGrantingTicket, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var results []*TicketGrantingTicket
+	for _, ticket := range r.tgts {
+		if ticket.Username == username && !expired(ticket.Expires) {
+			copied := *ticket
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (r *MemoryRegistry) CreateServiceTicket(ticket *ServiceTicket) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := *ticket
+	r.serviceTickets[ticket.Ticket] = &copied
+	return nil
+}
+
+// ConsumeServiceTicket removes the ticket under the write lock, so concurrent validations of the same
+// ticket cannot both succeed.
+func (r *MemoryRegistry) ConsumeServiceTicket(st, service string) (*ServiceTicket, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ticket, found := r.serviceTickets[st]
+	if !found {
+		return nil, ErrTicketNotFound
+	}
+
+	delete(r.serviceTickets, st)
+	if ticket.Service != service || expired(ticket.Expires) {
+		return nil, ErrTicketNotFound
+	}
+	return ticket, nil
+}
+
+func (r *MemoryRegistry) DeleteServiceTicket(st string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.serviceTickets, st)
+	return nil
+}
+
+func (r *MemoryRegistry) ListServiceTickets(username string) ([]*ServiceTicket, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var results []*ServiceTicket
+	for _, ticket := range r.serviceTickets {
+		if ticket.Username == username && !expired(ticket.Expires) {
+			copied := *ticket
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (r *MemoryRegistry) CreatePGT(ticket *ProxyGrantingTicket) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := *ticket
+	r.pgts[ticket.PGT] = &copied
+	return nil
+}
+
+func (r *MemoryRegistry) ValidatePGT(pgt string) (*ProxyGrantingTicket, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ticket, found := r.pgts[pgt]
+	if !found || expired(ticket.Expires) {
+		return nil, ErrTicketNotFound
+	}
+
+	copied := *ticket
+	return &copied, nil
+}
+
+func (r *MemoryRegistry) DeletePGT(pgt string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.pgts, pgt)
+	return nil
+}
+
+func (r *MemoryRegistry) ListPGTs(username string) ([]*ProxyGrantingTicket, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var results []*ProxyGrantingTicket
+	for _, ticket := range r.pgts {
+		if ticket.Username == username && !expired(ticket.Expires) {
+			copied := *ticket
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (r *MemoryRegistry) CreateProxyTicket(ticket *ProxyTicket) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := *ticket
+	r.proxyTickets[ticket.Ticket] = &copied
+	return nil
+}
+
+func (r *MemoryRegistry) ConsumeProxyTicket(pt, service string) (*ProxyTicket, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ticket, found := r.proxyTickets[pt]
+	if !found {
+		return nil, ErrTicketNotFound
+	}
+
+	delete(r.proxyTickets, pt)
+	if ticket.Service != service || expired(ticket.Expires) {
+		return nil, ErrTicketNotFound
+	}
+	return ticket, nil
+}
+
+func (r *MemoryRegistry) DeleteProxyTicket(pt string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.proxyTickets, pt)
+	return nil
+}
+
+func (r *MemoryRegistry) ListProxyTickets(username string) ([]*ProxyTicket, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var results []*ProxyTicket
+	for _, ticket := range r.proxyTickets {
+		if ticket.Username == username && !expired(ticket.Expires) {
+			copied := *ticket
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (r *MemoryRegistry) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close stops the sweeper and saves the last snapshot.
+func (r *MemoryRegistry) Close(ctx context.Context) error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.stopped.Wait()
+		err = registryError(constants.DB_REGISTRY_MEMORY, r.saveSnapshot())
+	})
+	return err
+}
+
+// Sweep removes the expired tickets.
+func (r *MemoryRegistry) Sweep() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for id, ticket := range r.tgts {
+		if expired(ticket.Expires) {
+			delete(r.tgts, id)
+		}
+	}
+	for id, ticket := range r.serviceTickets {
+		if expired(ticket.Expires) {
+			delete(r.serviceTickets, id)
+		}
+	}
+	for id, ticket := range r.pgts {
+		if expired(ticket.Expires) {
+			delete(r.pgts, id)
+		}
+	}
+	for id, ticket := range r.proxyTickets {
+		if expired(ticket.Expires) {
+			delete(r.proxyTickets, id)
+		}
+	}
+}
+
+func (r *MemoryRegistry) sweepEvery(interval time.Duration) {
+	defer r.stopped.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Sweep()
+			if err := r.saveSnapshot(); err != nil {
+				log.Printf("Error saving the ticket snapshot: %v", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *MemoryRegistry) loadSnapshot() error {
+	if r.snapshotFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.snapshotFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	for _, ticket := range snapshot.TGTs {
+		if !expired(ticket.Expires) {
+			r.tgts[ticket.TGT] = ticket
+		}
+	}
+	for _, ticket := range snapshot.PGTs {
+		if !expired(ticket.Expires) {
+			r.pgts[ticket.PGT] = ticket
+		}
+	}
+	return nil
+}
+
+// saveSnapshot writes the snapshot to a temporary file that replaces the previous one, so that
+// a crash while writing never leaves a truncated snapshot.
+func (r *MemoryRegistry) saveSnapshot() error {
+	if r.snapshotFile == "" {
+		return nil
+	}
+
+	var snapshot memorySnapshot
+	r.mutex.RLock()
+	for _, ticket := range r.tgts {
+		snapshot.TGTs = append(snapshot.TGTs, ticket)
+	}
+	for _, ticket := range r.pgts {
+		snapshot.PGTs = append(snapshot.PGTs, ticket)
+	}
+	data, err := json.Marshal(snapshot)
+	r.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// The TGTs hold ID tokens and refresh tokens, so only this user can read the file
+	tmp, err := os.CreateTemp(filepath.Dir(r.snapshotFile), filepath.Base(r.snapshotFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.snapshotFile)
+}
+
+func expired(expires time.Time) bool {
+	return time.Now().After(expires)
+}
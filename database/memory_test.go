@@ -0,0 +1,111 @@
+package database_test
+
+import (
+	"cas-to-oauth2/database"
+	"cas-to-oauth2/database/registrytest"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T) database.TicketRegistry {
+		registry, err := database.NewMemoryRegistry("", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return registry
+	})
+}
+
+func TestMemoryRegistryConcurrentConsume(t *testing.T) {
+	registry, err := database.NewMemoryRegistry("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close(context.Background())
+
+	const tickets = 50
+	for i := 0; i < tickets; i++ {
+		st := &database.ServiceTicket{
+			Ticket:  fmt.Sprintf("ST-%d", i),
+			Service: "https://app.example.edu/",
+			Expires: time.Now().Add(time.Minute),
+		}
+		if err := registry.CreateServiceTicket(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var consumed int64
+	var wg sync.WaitGroup
+	for validator := 0; validator < 8; validator++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < tickets; i++ {
+				if _, err := registry.ConsumeServiceTicket(fmt.Sprintf("ST-%d", i), "https://app.example.edu/"); err == nil {
+					atomic.AddInt64(&consumed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if consumed != tickets {
+		t.Fatalf("consumed %d service tickets, want %d", consumed, tickets)
+	}
+}
+
+func TestMemoryRegistrySnapshot(t *testing.T) {
+	ctx := context.Background()
+	snapshotFile := filepath.Join(t.TempDir(), "tickets.json")
+
+	registry, err := database.NewMemoryRegistry(snapshotFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	tickets := []*database.TicketGrantingTicket{
+		{TGT: "TGT-1", Username: "jdoe", Expires: expires},
+		{TGT: "TGT-2", Username: "jdoe", Expires: time.Now().Add(-time.Minute)},
+	}
+	for _, tgt := range tickets {
+		if err := registry.CreateTGT(tgt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.CreatePGT(&database.ProxyGrantingTicket{PGT: "PGT-1", Username: "jdoe", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.CreateServiceTicket(&database.ServiceTicket{Ticket: "ST-1", Service: "https://app.example.edu/", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := database.NewMemoryRegistry(snapshotFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close(ctx)
+
+	if _, err := restored.ValidateTGT("TGT-1"); err != nil {
+		t.Fatalf("TGT not restored: %v", err)
+	}
+	if _, err := restored.ValidatePGT("PGT-1"); err != nil {
+		t.Fatalf("PGT not restored: %v", err)
+	}
+	if _, err := restored.ValidateTGT("TGT-2"); err != database.ErrTicketNotFound {
+		t.Fatalf("expired TGT restored: %v", err)
+	}
+	if _, err := restored.ConsumeServiceTicket("ST-1", "https://app.example.edu/"); err != database.ErrTicketNotFound {
+		t.Fatalf("service ticket restored: %v", err)
+	}
+}
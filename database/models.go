@@ -0,0 +1,52 @@
+package database
+
+import "time"
+
+// ServiceTicket is a one-time ticket issued to a service after a successful login.
+type ServiceTicket struct {
+	Ticket     string              `bson:"ticket"`
+	Service    string              `bson:"service"`
+	Username   string              `bson:"username"`
+	Attributes map[string][]string `bson:"attributes,omitempty"`
+	IsDirect   bool                `bson:"isDirect"`
+	Expires    time.Time           `bson:"expires"`
+}
+
+// TicketGrantingTicket is the single sign-on session of an authenticated user.
+// Provider is the name of the upstream identity provider the user logged in with.
+// Subject, SessionID and IDToken identify the session at the OAuth2 provider, and
+// RefreshToken is the provider refresh token, encrypted before it is stored.
+type TicketGrantingTicket struct {
+	TGT          string              `bson:"tgt"`
+	Username     string              `bson:"username"`
+	Attributes   map[string][]string `bson:"attributes,omitempty"`
+	Provider     string              `bson:"provider,omitempty"`
+	IDToken      string              `bson:"idToken,omitempty"`
+	Subject      string              `bson:"sub,omitempty"`
+	SessionID    string              `bson:"sid,omitempty"`
+	RefreshToken string              `bson:"refreshToken,omitempty"`
+	RefreshedAt  time.Time           `bson:"refreshedAt"`
+	Expires      time.Time           `bson:"expires"`
+}
+
+// ProxyGrantingTicket lets a service get proxy tickets for other services on behalf of the user.
+// Service is the callback URL the ticket was sent to and Proxies the chain of proxies, most recent first.
+type ProxyGrantingTicket struct {
+	PGT        string              `bson:"pgt"`
+	Service    string              `bson:"service"`
+	Username   string              `bson:"username"`
+	Attributes map[string][]string `bson:"attributes,omitempty"`
+	Proxies    []string            `bson:"proxies,omitempty"`
+	Expires    time.Time           `bson:"expires"`
+}
+
+// ProxyTicket is a one-time ticket issued to a proxy for a target service.
+type ProxyTicket struct {
+	Ticket     string              `bson:"ticket"`
+	Service    string              `bson:"service"`
+	Username   string              `bson:"username"`
+	Attributes map[string][]string `bson:"attributes,omitempty"`
+	PGT        string              `bson:"pgt"`
+	Proxies    []string            `bson:"proxies,omitempty"`
+	Expires    time.Time           `bson:"expires"`
+}
@@ -0,0 +1,199 @@
+package database
+
+import (
+	"cas-to-oauth2/constants"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongoRegistry stores the tickets in one MongoDB collection per ticket type.
+type MongoRegistry struct {
+	*mongo.Database
+}
+
+func NewMongoRegistry(db *mongo.Database) *MongoRegistry {
+	return &MongoRegistry{db}
+}
+
+func (r *MongoRegistry) CreateTGT(ticket *TicketGrantingTicket) error {
+	return r.insert(constants.DB_COLLECTION_TGT, ticket)
+}
+
+func (r *MongoRegistry) ValidateTGT(tgt string) (*TicketGrantingTicket, error) {
+	var result TicketGrantingTicket
+	err := r.findValid(constants.DB_COLLECTION_TGT, bson.M{"tgt": tgt}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UpdateTGTRefresh saves the result of refreshing the upstream session of a TGT.
+func (r *MongoRegistry) UpdateTGTRefresh(tgt, refreshToken string, refreshedAt time.Time) error {
+	tgtColl := r.Collection(constants.DB_COLLECTION_TGT)
+	filter := bson.M{"tgt": tgt}
+	update := bson.M{"$set": bson.M{"refreshToken": refreshToken, "refreshedAt": refreshedAt}}
+	_, err := tgtColl.UpdateOne(ctx, filter, update)
+	return registryError(constants.DB_REGISTRY_MONGODB, err)
+}
+
+func (r *MongoRegistry) DeleteTGT(tgt string) error {
+	return r.delete(constants.DB_COLLECTION_TGT, bson.M{"tgt": tgt})
+}
+
+func (r *MongoRegistry) DeleteTGTsBySession(provider, sub, sid string) (int64, error) {
+	if sub == "" && sid == "" {
+		return 0, nil
+	}
+
+	tgtColl := r.Collection(constants.DB_COLLECTION_TGT)
+	filter := bson.M{"provider": provider}
+	if sub != "" {
+		filter["sub"] = sub
+	}
+	if sid != "" {
+		filter["sid"] = sid
+	}
+
+	result, err := tgtColl.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, registryError(constants.DB_REGISTRY_MONGODB, err)
+	}
+	return result.DeletedCount, nil
+}
+
+func (r *MongoRegistry) ListTGTs(username string) ([]*TicketGrantingTicket, error) {
+	var results []*TicketGrantingTicket
+	err := r.listValid(constants.DB_COLLECTION_TGT, username, &results)
+	return results, err
+}
+
+func (r *MongoRegistry) CreateServiceTicket(ticket *ServiceTicket) error {
+	return r.insert(constants.DB_COLLECTION_SERVICE_TICKETS, ticket)
+}
+
+// ConsumeServiceTicket finds and deletes the ticket in a single operation, so two racing
+// validations of the same ticket cannot both succeed. The service is compared after the
+// ticket is deleted, so a wrong service invalidates it too.
+func (r *MongoRegistry) ConsumeServiceTicket(st, service string) (*ServiceTicket, error) {
+	var result ServiceTicket
+	err := r.findAndDelete(constants.DB_COLLECTION_SERVICE_TICKETS, bson.M{"ticket": st}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Service != service {
+		return nil, ErrTicketNotFound
+	}
+	return &result, nil
+}
+
+func (r *MongoRegistry) DeleteServiceTicket(st string) error {
+	return r.delete(constants.DB_COLLECTION_SERVICE_TICKETS, bson.M{"ticket": st})
+}
+
+func (r *MongoRegistry) ListServiceTickets(username string) ([]*ServiceTicket, error) {
+	var results []*ServiceTicket
+	err := r.listValid(constants.DB_COLLECTION_SERVICE_TICKETS, username, &results)
+	return results, err
+}
+
+func (r *MongoRegistry) CreatePGT(ticket *ProxyGrantingTicket) error {
+	return r.insert(constants.DB_COLLECTION_PGT, ticket)
+}
+
+func (r *MongoRegistry) ValidatePGT(pgt string) (*ProxyGrantingTicket, error) {
+	var result ProxyGrantingTicket
+	err := r.findValid(constants.DB_COLLECTION_PGT, bson.M{"pgt": pgt}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (r *MongoRegistry) DeletePGT(pgt string) error {
+	return r.delete(constants.DB_COLLECTION_PGT, bson.M{"pgt": pgt})
+}
+
+func (r *MongoRegistry) ListPGTs(username string) ([]*ProxyGrantingTicket, error) {
+	var results []*ProxyGrantingTicket
+	err := r.listValid(constants.DB_COLLECTION_PGT, username, &results)
+	return results, err
+}
+
+func (r *MongoRegistry) CreateProxyTicket(ticket *ProxyTicket) error {
+	return r.insert(constants.DB_COLLECTION_PROXY_TICKETS, ticket)
+}
+
+func (r *MongoRegistry) ConsumeProxyTicket(pt, service string) (*ProxyTicket, error) {
+	var result ProxyTicket
+	err := r.findAndDelete(constants.DB_COLLECTION_PROXY_TICKETS, bson.M{"ticket": pt}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Service != service {
+		return nil, ErrTicketNotFound
+	}
+	return &result, nil
+}
+
+func (r *MongoRegistry) DeleteProxyTicket(pt string) error {
+	return r.delete(constants.DB_COLLECTION_PROXY_TICKETS, bson.M{"ticket": pt})
+}
+
+func (r *MongoRegistry) ListProxyTickets(username string) ([]*ProxyTicket, error) {
+	var results []*ProxyTicket
+	err := r.listValid(constants.DB_COLLECTION_PROXY_TICKETS, username, &results)
+	return results, err
+}
+
+func (r *MongoRegistry) Ping(ctx context.Context) error {
+	return registryError(constants.DB_REGISTRY_MONGODB, r.Client().Ping(ctx, nil))
+}
+
+func (r *MongoRegistry) Close(ctx context.Context) error {
+	return r.Client().Disconnect(ctx)
+}
+
+func (r *MongoRegistry) insert(collection string, ticket interface{}) error {
+	_, err := r.Collection(collection).InsertOne(ctx, ticket)
+	return registryError(constants.DB_REGISTRY_MONGODB, err)
+}
+
+// findValid decodes the unexpired ticket matching the filter into result.
+func (r *MongoRegistry) findValid(collection string, filter bson.M, result interface{}) error {
+	filter["expires"] = bson.M{"$gte": time.Now()}
+	err := r.Collection(collection).FindOne(ctx, filter).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrTicketNotFound
+	}
+	return registryError(constants.DB_REGISTRY_MONGODB, err)
+}
+
+// findAndDelete atomically removes the unexpired ticket matching the filter and decodes it into result.
+func (r *MongoRegistry) findAndDelete(collection string, filter bson.M, result interface{}) error {
+	filter["expires"] = bson.M{"$gte": time.Now()}
+	err := r.Collection(collection).FindOneAndDelete(ctx, filter).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrTicketNotFound
+	}
+	return registryError(constants.DB_REGISTRY_MONGODB, err)
+}
+
+// listValid decodes the unexpired tickets of the user into results.
+func (r *MongoRegistry) listValid(collection, username string, results interface{}) error {
+	filter := bson.M{"username": username, "expires": bson.M{"$gte": time.Now()}}
+	cursor, err := r.Collection(collection).Find(ctx, filter)
+	if err != nil {
+		return registryError(constants.DB_REGISTRY_MONGODB, err)
+	}
+	return registryError(constants.DB_REGISTRY_MONGODB, cursor.All(ctx, results))
+}
+
+func (r *MongoRegistry) delete(collection string, filter bson.M) error {
+	_, err := r.Collection(collection).DeleteOne(ctx, filter)
+	return registryError(constants.DB_REGISTRY_MONGODB, err)
+}
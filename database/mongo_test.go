@@ -0,0 +1,40 @@
+package database_test
+
+import (
+	"cas-to-oauth2/database"
+	"cas-to-oauth2/database/registrytest"
+	"cas-to-oauth2/internal/utils"
+	"context"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestMongoRegistry needs a MongoDB server, for example TEST_MONGO_URI=mongodb://localhost:27017.
+func TestMongoRegistry(t *testing.T) {
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGO_URI is not set")
+	}
+
+	ctx := context.Background()
+	admin, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Disconnect(ctx)
+
+	registrytest.Run(t, func(t *testing.T) database.TicketRegistry {
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The suite closes the registry, so the database is dropped with another client
+		name := "registrytest_" + utils.RandomString(8)
+		t.Cleanup(func() { _ = admin.Database(name).Drop(ctx) })
+		return database.NewMongoRegistry(client.Database(name))
+	})
+}
@@ -0,0 +1,400 @@
+package database
+
+import (
+	"cas-to-oauth2/constants"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisRegistry stores every ticket as a JSON value that Redis expires by itself. Sorted sets
+// scored by expiration index the tickets of each user, and the TGTs of each upstream subject and
+// session for back-channel logout. Each command touches a single key, so it works the same with
+// a standalone server, Sentinel or a cluster.
+//
+// Service and proxy tickets are consumed with GETDEL, so a validation for the wrong service also
+// invalidates the ticket, as the CAS protocol asks.
+type RedisRegistry struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+const (
+	redisTGT           = "tgt"
+	redisServiceTicket = "st"
+	redisPGT           = "pgt"
+	redisProxyTicket   = "pt"
+)
+
+// redisIndexScript adds a ticket to an index, drops the expired ones and makes the index
+// live as long as its last ticket.
+var redisIndexScript = redis.NewScript(`
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[3])
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('PEXPIREAT', KEYS[1], last[2])
+return 1
+`)
+
+func NewRedisRegistry(client redis.UniversalClient, prefix string) *RedisRegistry {
+	return &RedisRegistry{client: client, prefix: prefix}
+}
+
+func (r *RedisRegistry) CreateTGT(ticket *TicketGrantingTicket) error {
+	return r.save(redisTGT, ticket.TGT, ticket, ticket.Expires, r.tgtIndexes(ticket)...)
+}
+
+func (r *RedisRegistry) ValidateTGT(tgt string) (*TicketGrantingTicket, error) {
+	var result TicketGrantingTicket
+	if err := r.load(r.key(redisTGT, tgt), &result); err != nil {
+		return nil, err
+	}
+	if expired(result.Expires) {
+		return nil, ErrTicketNotFound
+	}
+	return &result, nil
+}
+
+// UpdateTGTRefresh rewrites the TGT only if it still exists, keeping its expiration.
+func (r *RedisRegistry) UpdateTGTRefresh(tgt, refreshToken string, refreshedAt time.Time) error {
+	var ticket TicketGrantingTicket
+	err := r.load(r.key(redisTGT, tgt), &ticket)
+	if errors.Is(err, ErrTicketNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ticket.RefreshToken, ticket.RefreshedAt = refreshToken, refreshedAt
+	data, err := json.Marshal(ticket)
+	if err != nil {
+		return registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+
+	err = r.client.SetArgs(ctx, r.key(redisTGT, tgt), data, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return registryError(constants.DB_REGISTRY_REDIS, err)
+}
+
+func (r *RedisRegistry) DeleteTGT(tgt string) error {
+	var ticket TicketGrantingTicket
+	err := r.consume(r.key(redisTGT, tgt), &ticket)
+	if errors.Is(err, ErrTicketNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.unindex(tgt, r.tgtIndexes(&ticket)...)
+}
+
+func (r *RedisRegistry) DeleteTGTsBySession(provider, sub, sid string) (int64, error) {
+	var index string
+	switch {
+	case sid != "":
+		index = r.index(redisTGT, "sid", provider, sid)
+	case sub != "":
+		index = r.index(redisTGT, "sub", provider, sub)
+	default:
+		return 0, nil
+	}
+
+	ids, err := r.client.ZRange(ctx, index, 0, -1).Result()
+	if err != nil {
+		return 0, registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+
+	var deleted int64
+	for _, id := range ids {
+		var ticket TicketGrantingTicket
+		err := r.load(r.key(redisTGT, id), &ticket)
+		if errors.Is(err, ErrTicketNotFound) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if sub != "" && ticket.Subject != sub {
+			continue
+		}
+
+		count, err := r.client.Del(ctx, r.key(redisTGT, id)).Result()
+		if err != nil {
+			return deleted, registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+		deleted += count
+
+		if err := r.unindex(id, r.tgtIndexes(&ticket)...); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func (r *RedisRegistry) ListTGTs(username string) ([]*TicketGrantingTicket, error) {
+	values, err := r.list(redisTGT, username)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*TicketGrantingTicket
+	for _, value := range values {
+		var ticket TicketGrantingTicket
+		if err := json.Unmarshal([]byte(value), &ticket); err != nil {
+			return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+		results = append(results, &ticket)
+	}
+	return results, nil
+}
+
+func (r *RedisRegistry) CreateServiceTicket(ticket *ServiceTicket) error {
+	return r.save(redisServiceTicket, ticket.Ticket, ticket, ticket.Expires, r.userIndex(redisServiceTicket, ticket.Username))
+}
+
+func (r *RedisRegistry) ConsumeServiceTicket(st, service string) (*ServiceTicket, error) {
+	var result ServiceTicket
+	if err := r.consume(r.key(redisServiceTicket, st), &result); err != nil {
+		return nil, err
+	}
+	if result.Service != service || expired(result.Expires) {
+		return nil, ErrTicketNotFound
+	}
+	return &result, nil
+}
+
+func (r *RedisRegistry) DeleteServiceTicket(st string) error {
+	return registryError(constants.DB_REGISTRY_REDIS, r.client.Del(ctx, r.key(redisServiceTicket, st)).Err())
+}
+
+func (r *RedisRegistry) ListServiceTickets(username string) ([]*ServiceTicket, error) {
+	values, err := r.list(redisServiceTicket, username)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*ServiceTicket
+	for _, value := range values {
+		var ticket ServiceTicket
+		if err := json.Unmarshal([]byte(value), &ticket); err != nil {
+			return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+		results = append(results, &ticket)
+	}
+	return results, nil
+}
+
+func (r *RedisRegistry) CreatePGT(ticket *ProxyGrantingTicket) error {
+	return r.save(redisPGT, ticket.PGT, ticket, ticket.Expires, r.userIndex(redisPGT, ticket.Username))
+}
+
+func (r *RedisRegistry) ValidatePGT(pgt string) (*ProxyGrantingTicket, error) {
+	var result ProxyGrantingTicket
+	if err := r.load(r.key(redisPGT, pgt), &result); err != nil {
+		return nil, err
+	}
+	if expired(result.Expires) {
+		return nil, ErrTicketNotFound
+	}
+	return &result, nil
+}
+
+func (r *RedisRegistry) DeletePGT(pgt string) error {
+	return registryError(constants.DB_REGISTRY_REDIS, r.client.Del(ctx, r.key(redisPGT, pgt)).Err())
+}
+
+func (r *RedisRegistry) ListPGTs(username string) ([]*ProxyGrantingTicket, error) {
+	values, err := r.list(redisPGT, username)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*ProxyGrantingTicket
+	for _, value := range values {
+		var ticket ProxyGrantingTicket
+		if err := json.Unmarshal([]byte(value), &ticket); err != nil {
+			return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+		results = append(results, &ticket)
+	}
+	return results, nil
+}
+
+func (r *RedisRegistry) CreateProxyTicket(ticket *ProxyTicket) error {
+	return r.save(redisProxyTicket, ticket.Ticket, ticket, ticket.Expires, r.userIndex(redisProxyTicket, ticket.Username))
+}
+
+func (r *RedisRegistry) ConsumeProxyTicket(pt, service string) (*ProxyTicket, error) {
+	var result ProxyTicket
+	if err := r.consume(r.key(redisProxyTicket, pt), &result); err != nil {
+		return nil, err
+	}
+	if result.Service != service || expired(result.Expires) {
+		return nil, ErrTicketNotFound
+	}
+	return &result, nil
+}
+
+func (r *RedisRegistry) DeleteProxyTicket(pt string) error {
+	return registryError(constants.DB_REGISTRY_REDIS, r.client.Del(ctx, r.key(redisProxyTicket, pt)).Err())
+}
+
+func (r *RedisRegistry) ListProxyTickets(username string) ([]*ProxyTicket, error) {
+	values, err := r.list(redisProxyTicket, username)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*ProxyTicket
+	for _, value := range values {
+		var ticket ProxyTicket
+		if err := json.Unmarshal([]byte(value), &ticket); err != nil {
+			return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+		results = append(results, &ticket)
+	}
+	return results, nil
+}
+
+func (r *RedisRegistry) Ping(ctx context.Context) error {
+	return registryError(constants.DB_REGISTRY_REDIS, r.client.Ping(ctx).Err())
+}
+
+func (r *RedisRegistry) Close(ctx context.Context) error {
+	return r.client.Close()
+}
+
+func (r *RedisRegistry) key(kind, id string) string {
+	return r.prefix + kind + ":" + id
+}
+
+func (r *RedisRegistry) userIndex(kind, username string) string {
+	return r.index(kind, "user", username)
+}
+
+// tgtIndexes returns the indexes of the TGT: its user and, when known, its upstream subject and session.
+func (r *RedisRegistry) tgtIndexes(ticket *TicketGrantingTicket) []string {
+	indexes := []string{r.userIndex(redisTGT, ticket.Username)}
+	if ticket.Subject != "" {
+		indexes = append(indexes, r.index(redisTGT, "sub", ticket.Provider, ticket.Subject))
+	}
+	if ticket.SessionID != "" {
+		indexes = append(indexes, r.index(redisTGT, "sid", ticket.Provider, ticket.SessionID))
+	}
+	return indexes
+}
+
+func (r *RedisRegistry) index(kind string, parts ...string) string {
+	index := r.prefix + "index:" + kind
+	for _, part := range parts {
+		index += ":" + part
+	}
+	return index
+}
+
+// save stores the ticket until it expires and adds it to the given indexes.
+// An already expired ticket is not stored at all.
+func (r *RedisRegistry) save(kind, id string, ticket interface{}, expires time.Time, indexes ...string) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(ticket)
+	if err != nil {
+		return registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+
+	if err := r.client.Set(ctx, r.key(kind, id), data, ttl).Err(); err != nil {
+		return registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+
+	score := strconv.FormatInt(expires.UnixMilli(), 10)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	for _, index := range indexes {
+		if err := redisIndexScript.Run(ctx, r.client, []string{index}, score, id, now).Err(); err != nil {
+			return registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+	}
+	return nil
+}
+
+// unindex removes a deleted ticket from its indexes. An index left empty is removed by Redis.
+func (r *RedisRegistry) unindex(id string, indexes ...string) error {
+	for _, index := range indexes {
+		if err := r.client.ZRem(ctx, index, id).Err(); err != nil {
+			return registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+	}
+	return nil
+}
+
+func (r *RedisRegistry) load(key string, result interface{}) error {
+	data, err := r.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ErrTicketNotFound
+	}
+	if err != nil {
+		return registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+	return registryError(constants.DB_REGISTRY_REDIS, json.Unmarshal(data, result))
+}
+
+func (r *RedisRegistry) consume(key string, result interface{}) error {
+	data, err := r.client.GetDel(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ErrTicketNotFound
+	}
+	if err != nil {
+		return registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+	return registryError(constants.DB_REGISTRY_REDIS, json.Unmarshal(data, result))
+}
+
+// list returns the tickets of the user that have not expired. Consumed tickets, which are not
+// removed from the index when they are consumed, are removed here when they are found missing.
+func (r *RedisRegistry) list(kind, username string) ([]string, error) {
+	index := r.userIndex(kind, username)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	ids, err := r.client.ZRangeByScore(ctx, index, &redis.ZRangeBy{Min: "(" + now, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+
+	// A pipeline instead of MGET, whose keys would live in different slots of a cluster
+	pipe := r.client.Pipeline()
+	gets := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		gets[i] = pipe.Get(ctx, r.key(kind, id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+	}
+
+	var values, missing []string
+	for i, get := range gets {
+		value, err := get.Result()
+		if errors.Is(err, redis.Nil) {
+			missing = append(missing, ids[i])
+			continue
+		}
+		if err != nil {
+			return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+		values = append(values, value)
+	}
+
+	if len(missing) > 0 {
+		if err := r.client.ZRem(ctx, index, missing).Err(); err != nil {
+			return nil, registryError(constants.DB_REGISTRY_REDIS, err)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,186 @@
+package database_test
+
+import (
+	"cas-to-oauth2/database"
+	"cas-to-oauth2/database/registrytest"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newRedisRegistry(t *testing.T) (*database.RedisRegistry, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	return database.NewRedisRegistry(client, "cas:"), server
+}
+
+func TestRedisRegistry(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T) database.TicketRegistry {
+		registry, _ := newRedisRegistry(t)
+		return registry
+	})
+}
+
+func TestRedisRegistryNativeExpiry(t *testing.T) {
+	registry, server := newRedisRegistry(t)
+	defer registry.Close(context.Background())
+
+	tgt := &database.TicketGrantingTicket{TGT: "TGT-1", Username: "jdoe", Expires: time.Now().Add(time.Hour)}
+	if err := registry.CreateTGT(tgt); err != nil {
+		t.Fatal(err)
+	}
+	st := &database.ServiceTicket{Ticket: "ST-1", Service: "https://app.example.edu/", Username: "jdoe", Expires: time.Now().Add(time.Minute)}
+	if err := registry.CreateServiceTicket(st); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := server.TTL("cas:tgt:TGT-1"); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("TGT TTL is %v, want about an hour", ttl)
+	}
+	if ttl := server.TTL("cas:index:tgt:user:jdoe"); ttl <= 0 {
+		t.Fatalf("user index has no TTL")
+	}
+
+	server.FastForward(2 * time.Minute)
+	if server.Exists("cas:st:ST-1") {
+		t.Fatal("service ticket did not expire")
+	}
+	if _, err := registry.ValidateTGT("TGT-1"); err != nil {
+		t.Fatalf("TGT expired early: %v", err)
+	}
+
+	server.FastForward(time.Hour)
+	if server.Exists("cas:tgt:TGT-1") || server.Exists("cas:index:tgt:user:jdoe") {
+		t.Fatal("TGT or its index did not expire")
+	}
+}
+
+func TestRedisRegistryConsumeInvalidatesTicket(t *testing.T) {
+	registry, _ := newRedisRegistry(t)
+	defer registry.Close(context.Background())
+
+	st := &database.ServiceTicket{Ticket: "ST-1", Service: "https://app.example.edu/", Expires: time.Now().Add(time.Minute)}
+	if err := registry.CreateServiceTicket(st); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := registry.ConsumeServiceTicket(st.Ticket, "https://evil.example.com/"); err != database.ErrTicketNotFound {
+		t.Fatalf("got error %v for the wrong service", err)
+	}
+	if _, err := registry.ConsumeServiceTicket(st.Ticket, st.Service); err != database.ErrTicketNotFound {
+		t.Fatalf("ticket still valid after a failed validation: %v", err)
+	}
+}
+
+func TestRedisRegistryListSkipsDeletedTickets(t *testing.T) {
+	registry, server := newRedisRegistry(t)
+	defer registry.Close(context.Background())
+
+	for _, id := range []string{"TGT-1", "TGT-2"} {
+		tgt := &database.TicketGrantingTicket{TGT: id, Username: "jdoe", Expires: time.Now().Add(time.Hour)}
+		if err := registry.CreateTGT(tgt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.DeleteTGT("TGT-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tgts, err := registry.ListTGTs("jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgts) != 1 || tgts[0].TGT != "TGT-2" {
+		t.Fatalf("listed %v, want only TGT-2", tgts)
+	}
+
+	members, err := server.ZMembers("cas:index:tgt:user:jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 {
+		t.Fatalf("index still has %v", members)
+	}
+}
+
+func TestRedisRegistryTGTIndexes(t *testing.T) {
+	registry, server := newRedisRegistry(t)
+	defer registry.Close(context.Background())
+
+	for _, id := range []string{"TGT-1", "TGT-2", "TGT-3"} {
+		tgt := &database.TicketGrantingTicket{
+			TGT:       id,
+			Username:  "jdoe",
+			Provider:  "default",
+			Subject:   "sub-jdoe",
+			SessionID: "sid-" + id,
+			Expires:   time.Now().Add(time.Hour),
+		}
+		if err := registry.CreateTGT(tgt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertIndex := func(index string, want ...string) {
+		t.Helper()
+		members, _ := server.ZMembers(index)
+		if strings.Join(members, " ") != strings.Join(want, " ") {
+			t.Fatalf("index %s has %v, want %v", index, members, want)
+		}
+	}
+	assertIndex("cas:index:tgt:user:jdoe", "TGT-1", "TGT-2", "TGT-3")
+	assertIndex("cas:index:tgt:sub:default:sub-jdoe", "TGT-1", "TGT-2", "TGT-3")
+
+	// Deleting a TGT removes it from every index at once, not when the user is listed
+	if err := registry.DeleteTGT("TGT-1"); err != nil {
+		t.Fatal(err)
+	}
+	assertIndex("cas:index:tgt:user:jdoe", "TGT-2", "TGT-3")
+	assertIndex("cas:index:tgt:sub:default:sub-jdoe", "TGT-2", "TGT-3")
+	if server.Exists("cas:index:tgt:sid:default:sid-TGT-1") {
+		t.Fatal("session index of the deleted TGT is left")
+	}
+
+	if _, err := registry.DeleteTGTsBySession("default", "", "sid-TGT-2"); err != nil {
+		t.Fatal(err)
+	}
+	assertIndex("cas:index:tgt:user:jdoe", "TGT-3")
+	assertIndex("cas:index:tgt:sub:default:sub-jdoe", "TGT-3")
+
+	if _, err := registry.DeleteTGTsBySession("default", "sub-jdoe", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []string{"cas:index:tgt:user:jdoe", "cas:index:tgt:sub:default:sub-jdoe", "cas:index:tgt:sid:default:sid-TGT-3"} {
+		if server.Exists(index) {
+			t.Fatalf("index %s is left after deleting every TGT", index)
+		}
+	}
+
+	// An index expires with the last of its TGTs
+	expiring := &database.TicketGrantingTicket{TGT: "TGT-4", Username: "jdoe", Expires: time.Now().Add(time.Minute)}
+	if err := registry.CreateTGT(expiring); err != nil {
+		t.Fatal(err)
+	}
+	assertIndex("cas:index:tgt:user:jdoe", "TGT-4")
+	server.FastForward(2 * time.Minute)
+	if server.Exists("cas:index:tgt:user:jdoe") {
+		t.Fatal("user index outlived its TGTs")
+	}
+}
+
+func TestRedisRegistryUnavailable(t *testing.T) {
+	registry, server := newRedisRegistry(t)
+	defer registry.Close(context.Background())
+	server.Close()
+
+	_, err := registry.ConsumeServiceTicket("ST-1", "https://app.example.edu/")
+	var registryErr *database.RegistryError
+	if !errors.As(err, &registryErr) {
+		t.Fatalf("got error %v, want a RegistryError", err)
+	}
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"cas-to-oauth2/constants"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTicketNotFound is returned when a ticket does not exist, has expired, was already consumed
+// or was issued for another service.
+var ErrTicketNotFound = errors.New(constants.DB_ERRMSG_NOT_FOUND)
+
+// RegistryError is returned when the backend of the registry fails, for example when the database
+// is unreachable. The operation may or may not have taken place.
+type RegistryError struct {
+	Backend string
+	Err     error
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf(constants.DB_ERRMSG_REGISTRY, e.Backend, e.Err)
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// Registry is the ticket registry used by the handlers.
+var Registry TicketRegistry
+
+// TicketRegistry stores the CAS tickets. Validate returns a ticket that can be used again, Consume
+// returns a one-time ticket and removes it, so it is only returned once. A one-time ticket asked for
+// another service is not returned and is removed too, CAS allows a single validation attempt per
+// ticket. Expired tickets are never returned.
+// Deleting a ticket that does not exist is not an error. Every other error is a *RegistryError.
+// Every implementation must pass the conformance suite in the registrytest package.
+type TicketRegistry interface {
+	CreateTGT(ticket *TicketGrantingTicket) error
+	ValidateTGT(tgt string) (*TicketGrantingTicket, error)
+	UpdateTGTRefresh(tgt, refreshToken string, refreshedAt time.Time) error
+	DeleteTGT(tgt string) error
+	// DeleteTGTsBySession deletes every TGT of the upstream session sid or, when sid is empty,
+	// every TGT of the upstream subject sub, created by the given provider.
+	DeleteTGTsBySession(provider, sub, sid string) (int64, error)
+	ListTGTs(username string) ([]*TicketGrantingTicket, error)
+
+	CreateServiceTicket(ticket *ServiceTicket) error
+	ConsumeServiceTicket(st, service string) (*ServiceTicket, error)
+	DeleteServiceTicket(st string) error
+	ListServiceTickets(username string) ([]*ServiceTicket, error)
+
+	CreatePGT(ticket *ProxyGrantingTicket) error
+	ValidatePGT(pgt string) (*ProxyGrantingTicket, error)
+	DeletePGT(pgt string) error
+	ListPGTs(username string) ([]*ProxyGrantingTicket, error)
+
+	CreateProxyTicket(ticket *ProxyTicket) error
+	ConsumeProxyTicket(pt, service string) (*ProxyTicket, error)
+	DeleteProxyTicket(pt string) error
+	ListProxyTickets(username string) ([]*ProxyTicket, error)
+
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// registryError wraps the errors of the backend in a RegistryError, leaving ErrTicketNotFound as is.
+func registryError(backend string, err error) error {
+	var registryErr *RegistryError
+	if err == nil || errors.Is(err, ErrTicketNotFound) || errors.As(err, &registryErr) {
+		return err
+	}
+	return &RegistryError{Backend: backend, Err: err}
+}
@@ -0,0 +1,396 @@
+// Package registrytest is the conformance suite every database.TicketRegistry implementation must pass.
+// Call Run from a test next to the implementation.
+package registrytest
+
+import (
+	"cas-to-oauth2/database"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// NewRegistry returns an empty registry, it is called once per test.
+type NewRegistry func(t *testing.T) database.TicketRegistry
+
+// Run runs the conformance suite against the registries returned by newRegistry.
+func Run(t *testing.T, newRegistry NewRegistry) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, registry database.TicketRegistry)
+	}{
+		{"Ping", testPing},
+		{"TGT", testTGT},
+		{"TGTExpired", testTGTExpired},
+		{"TGTRefresh", testTGTRefresh},
+		{"TGTDeleteBySession", testTGTDeleteBySession},
+		{"ServiceTicketConsumedOnce", testServiceTicketConsumedOnce},
+		{"ServiceTicketWrongService", testServiceTicketWrongService},
+		{"ServiceTicketExpired", testServiceTicketExpired},
+		{"PGT", testPGT},
+		{"ProxyTicketConsumedOnce", testProxyTicketConsumedOnce},
+		{"ProxyTicketWrongService", testProxyTicketWrongService},
+		{"ListByUser", testListByUser},
+		{"UnknownTickets", testUnknownTickets},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newRegistry(t)
+			t.Cleanup(func() { _ = registry.Close(context.Background()) })
+			tt.test(t, registry)
+		})
+	}
+}
+
+var attributes = map[string][]string{
+	"email":  {"jdoe@example.edu"},
+	"groups": {"staff", "teachers"},
+}
+
+// expires returns an expiration time that survives the time precision of every backend.
+func expires(d time.Duration) time.Time {
+	return time.Now().Add(d).Truncate(time.Second)
+}
+
+func newTGT(id, username string) *database.TicketGrantingTicket {
+	return &database.TicketGrantingTicket{
+		TGT:          id,
+		Username:     username,
+		Attributes:   attributes,
+		Provider:     "default",
+		IDToken:      "id-token",
+		Subject:      "sub-" + username,
+		SessionID:    "sid-" + id,
+		RefreshToken: "refresh-token",
+		RefreshedAt:  expires(-time.Minute),
+		Expires:      expires(time.Hour),
+	}
+}
+
+func newServiceTicket(id, username string) *database.ServiceTicket {
+	return &database.ServiceTicket{
+		Ticket:     id,
+		Service:    "https://app.example.edu/",
+		Username:   username,
+		Attributes: attributes,
+		IsDirect:   true,
+		Expires:    expires(time.Minute),
+	}
+}
+
+func newPGT(id, username string) *database.ProxyGrantingTicket {
+	return &database.ProxyGrantingTicket{
+		PGT:        id,
+		Service:    "https://proxy.example.edu/callback",
+		Username:   username,
+		Attributes: attributes,
+		Proxies:    []string{"https://first.example.edu/callback"},
+		Expires:    expires(time.Hour),
+	}
+}
+
+func newProxyTicket(id, username string) *database.ProxyTicket {
+	return &database.ProxyTicket{
+		Ticket:     id,
+		Service:    "https://backend.example.edu/",
+		Username:   username,
+		Attributes: attributes,
+		PGT:        "PGT-1",
+		Proxies:    []string{"https://proxy.example.edu/callback"},
+		Expires:    expires(time.Minute),
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func mustNotFound(t *testing.T, err error) {
+	t.Helper()
+	if !errors.Is(err, database.ErrTicketNotFound) {
+		t.Fatalf("got error %v, want ErrTicketNotFound", err)
+	}
+}
+
+// assertEqual compares two tickets, with the times compared as instants.
+func assertEqual(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(normalize(got), normalize(want)) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func normalize(ticket interface{}) interface{} {
+	switch v := ticket.(type) {
+	case *database.TicketGrantingTicket:
+		c := *v
+		c.RefreshedAt, c.Expires = c.RefreshedAt.UTC(), c.Expires.UTC()
+		return c
+	case *database.ServiceTicket:
+		c := *v
+		c.Expires = c.Expires.UTC()
+		return c
+	case *database.ProxyGrantingTicket:
+		c := *v
+		c.Expires = c.Expires.UTC()
+		return c
+	case *database.ProxyTicket:
+		c := *v
+		c.Expires = c.Expires.UTC()
+		return c
+	}
+	return ticket
+}
+
+func testPing(t *testing.T, registry database.TicketRegistry) {
+	must(t, registry.Ping(context.Background()))
+}
+
+func testTGT(t *testing.T, registry database.TicketRegistry) {
+	tgt := newTGT("TGT-1", "jdoe")
+	must(t, registry.CreateTGT(tgt))
+
+	// A TGT is validated as many times as needed
+	for i := 0; i < 2; i++ {
+		got, err := registry.ValidateTGT(tgt.TGT)
+		must(t, err)
+		assertEqual(t, got, tgt)
+	}
+
+	must(t, registry.DeleteTGT(tgt.TGT))
+	_, err := registry.ValidateTGT(tgt.TGT)
+	mustNotFound(t, err)
+}
+
+func testTGTExpired(t *testing.T, registry database.TicketRegistry) {
+	tgt := newTGT("TGT-1", "jdoe")
+	tgt.Expires = expires(-time.Minute)
+	must(t, registry.CreateTGT(tgt))
+
+	_, err := registry.ValidateTGT(tgt.TGT)
+	mustNotFound(t, err)
+}
+
+func testTGTRefresh(t *testing.T, registry database.TicketRegistry) {
+	tgt := newTGT("TGT-1", "jdoe")
+	must(t, registry.CreateTGT(tgt))
+
+	refreshedAt := expires(0)
+	must(t, registry.UpdateTGTRefresh(tgt.TGT, "new-refresh-token", refreshedAt))
+
+	got, err := registry.ValidateTGT(tgt.TGT)
+	must(t, err)
+	tgt.RefreshToken, tgt.RefreshedAt = "new-refresh-token", refreshedAt
+	assertEqual(t, got, tgt)
+}
+
+func testTGTDeleteBySession(t *testing.T, registry database.TicketRegistry) {
+	first := newTGT("TGT-1", "jdoe")
+	second := newTGT("TGT-2", "jdoe")
+	otherProvider := newTGT("TGT-3", "jdoe")
+	otherProvider.Provider = "staff"
+	otherUser := newTGT("TGT-4", "asmith")
+	for _, tgt := range []*database.TicketGrantingTicket{first, second, otherProvider, otherUser} {
+		must(t, registry.CreateTGT(tgt))
+	}
+
+	// By session, only the TGT of that session
+	deleted, err := registry.DeleteTGTsBySession("default", "", first.SessionID)
+	must(t, err)
+	if deleted != 1 {
+		t.Fatalf("deleted %d TGTs by session, want 1", deleted)
+	}
+	_, err = registry.ValidateTGT(first.TGT)
+	mustNotFound(t, err)
+
+	// By subject, every TGT of the subject at that provider
+	deleted, err = registry.DeleteTGTsBySession("default", second.Subject, "")
+	must(t, err)
+	if deleted != 1 {
+		t.Fatalf("deleted %d TGTs by subject, want 1", deleted)
+	}
+	_, err = registry.ValidateTGT(second.TGT)
+	mustNotFound(t, err)
+
+	for _, tgt := range []*database.TicketGrantingTicket{otherProvider, otherUser} {
+		_, err := registry.ValidateTGT(tgt.TGT)
+		must(t, err)
+	}
+
+	// Without subject nor session nothing is deleted
+	deleted, err = registry.DeleteTGTsBySession("staff", "", "")
+	must(t, err)
+	if deleted != 0 {
+		t.Fatalf("deleted %d TGTs without subject nor session, want 0", deleted)
+	}
+}
+
+func testServiceTicketConsumedOnce(t *testing.T, registry database.TicketRegistry) {
+	st := newServiceTicket("ST-1", "jdoe")
+	must(t, registry.CreateServiceTicket(st))
+
+	got, err := registry.ConsumeServiceTicket(st.Ticket, st.Service)
+	must(t, err)
+	assertEqual(t, got, st)
+
+	_, err = registry.ConsumeServiceTicket(st.Ticket, st.Service)
+	mustNotFound(t, err)
+}
+
+func testServiceTicketWrongService(t *testing.T, registry database.TicketRegistry) {
+	st := newServiceTicket("ST-1", "jdoe")
+	must(t, registry.CreateServiceTicket(st))
+
+	// A validation for another service fails and invalidates the ticket
+	_, err := registry.ConsumeServiceTicket(st.Ticket, "https://evil.example.com/")
+	mustNotFound(t, err)
+	_, err = registry.ConsumeServiceTicket(st.Ticket, st.Service)
+	mustNotFound(t, err)
+
+	deleted := newServiceTicket("ST-2", "jdoe")
+	must(t, registry.CreateServiceTicket(deleted))
+	must(t, registry.DeleteServiceTicket(deleted.Ticket))
+	_, err = registry.ConsumeServiceTicket(deleted.Ticket, deleted.Service)
+	mustNotFound(t, err)
+}
+
+func testServiceTicketExpired(t *testing.T, registry database.TicketRegistry) {
+	st := newServiceTicket("ST-1", "jdoe")
+	st.Expires = expires(-time.Minute)
+	must(t, registry.CreateServiceTicket(st))
+
+	_, err := registry.ConsumeServiceTicket(st.Ticket, st.Service)
+	mustNotFound(t, err)
+}
+
+func testPGT(t *testing.T, registry database.TicketRegistry) {
+	pgt := newPGT("PGT-1", "jdoe")
+	must(t, registry.CreatePGT(pgt))
+
+	for i := 0; i < 2; i++ {
+		got, err := registry.ValidatePGT(pgt.PGT)
+		must(t, err)
+		assertEqual(t, got, pgt)
+	}
+
+	must(t, registry.DeletePGT(pgt.PGT))
+	_, err := registry.ValidatePGT(pgt.PGT)
+	mustNotFound(t, err)
+
+	expired := newPGT("PGT-2", "jdoe")
+	expired.Expires = expires(-time.Minute)
+	must(t, registry.CreatePGT(expired))
+	_, err = registry.ValidatePGT(expired.PGT)
+	mustNotFound(t, err)
+}
+
+func testProxyTicketConsumedOnce(t *testing.T, registry database.TicketRegistry) {
+	pt := newProxyTicket("PT-1", "jdoe")
+	must(t, registry.CreateProxyTicket(pt))
+
+	got, err := registry.ConsumeProxyTicket(pt.Ticket, pt.Service)
+	must(t, err)
+	assertEqual(t, got, pt)
+
+	_, err = registry.ConsumeProxyTicket(pt.Ticket, pt.Service)
+	mustNotFound(t, err)
+
+	second := newProxyTicket("PT-2", "jdoe")
+	must(t, registry.CreateProxyTicket(second))
+	must(t, registry.DeleteProxyTicket(second.Ticket))
+	_, err = registry.ConsumeProxyTicket(second.Ticket, second.Service)
+	mustNotFound(t, err)
+}
+
+func testListByUser(t *testing.T, registry database.TicketRegistry) {
+	for i := 1; i <= 2; i++ {
+		must(t, registry.CreateTGT(newTGT(fmt.Sprintf("TGT-%d", i), "jdoe")))
+		must(t, registry.CreateServiceTicket(newServiceTicket(fmt.Sprintf("ST-%d", i), "jdoe")))
+		must(t, registry.CreatePGT(newPGT(fmt.Sprintf("PGT-%d", i), "jdoe")))
+		must(t, registry.CreateProxyTicket(newProxyTicket(fmt.Sprintf("PT-%d", i), "jdoe")))
+	}
+	must(t, registry.CreateTGT(newTGT("TGT-3", "asmith")))
+	expired := newTGT("TGT-4", "jdoe")
+	expired.Expires = expires(-time.Minute)
+	must(t, registry.CreateTGT(expired))
+
+	tgts, err := registry.ListTGTs("jdoe")
+	must(t, err)
+	var ids []string
+	for _, tgt := range tgts {
+		ids = append(ids, tgt.TGT)
+	}
+	assertIDs(t, ids, "TGT-1", "TGT-2")
+
+	sts, err := registry.ListServiceTickets("jdoe")
+	must(t, err)
+	ids = nil
+	for _, st := range sts {
+		ids = append(ids, st.Ticket)
+	}
+	assertIDs(t, ids, "ST-1", "ST-2")
+
+	pgts, err := registry.ListPGTs("jdoe")
+	must(t, err)
+	ids = nil
+	for _, pgt := range pgts {
+		ids = append(ids, pgt.PGT)
+	}
+	assertIDs(t, ids, "PGT-1", "PGT-2")
+
+	pts, err := registry.ListProxyTickets("jdoe")
+	must(t, err)
+	ids = nil
+	for _, pt := range pts {
+		ids = append(ids, pt.Ticket)
+	}
+	assertIDs(t, ids, "PT-1", "PT-2")
+
+	tgts, err = registry.ListTGTs("nobody")
+	must(t, err)
+	if len(tgts) != 0 {
+		t.Fatalf("listed %d TGTs of an unknown user", len(tgts))
+	}
+}
+
+func assertIDs(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+}
+
+func testProxyTicketWrongService(t *testing.T, registry database.TicketRegistry) {
+	pt := newProxyTicket("PT-1", "jdoe")
+	must(t, registry.CreateProxyTicket(pt))
+
+	// A validation for another service fails and invalidates the ticket
+	_, err := registry.ConsumeProxyTicket(pt.Ticket, "https://evil.example.com/")
+	mustNotFound(t, err)
+	_, err = registry.ConsumeProxyTicket(pt.Ticket, pt.Service)
+	mustNotFound(t, err)
+}
+
+func testUnknownTickets(t *testing.T, registry database.TicketRegistry) {
+	_, err := registry.ValidateTGT("TGT-unknown")
+	mustNotFound(t, err)
+	_, err = registry.ConsumeServiceTicket("ST-unknown", "https://app.example.edu/")
+	mustNotFound(t, err)
+	_, err = registry.ValidatePGT("PGT-unknown")
+	mustNotFound(t, err)
+	_, err = registry.ConsumeProxyTicket("PT-unknown", "https://app.example.edu/")
+	mustNotFound(t, err)
+
+	must(t, registry.DeleteTGT("TGT-unknown"))
+	must(t, registry.DeleteServiceTicket("ST-unknown"))
+	must(t, registry.DeletePGT("PGT-unknown"))
+	must(t, registry.DeleteProxyTicket("PT-unknown"))
+}
@@ -0,0 +1,548 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SQLRegistry stores the tickets in a SQL database through database/sql. The queries are written
+// for PostgreSQL and SQLite. Times are stored as Unix milliseconds so that both behave the same.
+type SQLRegistry struct {
+	db *sql.DB
+
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// sqlMigrations are applied in order, each one once, and recorded in the schema_migrations table.
+// Never change a released migration, append a new one.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS ticket_granting_tickets (
+			tgt VARCHAR(255) PRIMARY KEY,
+			username VARCHAR(255) NOT NULL,
+			attributes TEXT NOT NULL,
+			provider VARCHAR(255) NOT NULL,
+			id_token TEXT NOT NULL,
+			sub VARCHAR(255) NOT NULL,
+			sid VARCHAR(255) NOT NULL,
+			refresh_token TEXT NOT NULL,
+			refreshed_at BIGINT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ticket_granting_tickets_username ON ticket_granting_tickets (username)`,
+		`CREATE INDEX IF NOT EXISTS ticket_granting_tickets_sub ON ticket_granting_tickets (provider, sub)`,
+		`CREATE INDEX IF NOT EXISTS ticket_granting_tickets_sid ON ticket_granting_tickets (provider, sid)`,
+		`CREATE INDEX IF NOT EXISTS ticket_granting_tickets_expires ON ticket_granting_tickets (expires)`,
+		`CREATE TABLE IF NOT EXISTS service_tickets (
+			ticket VARCHAR(255) PRIMARY KEY,
+			service TEXT NOT NULL,
+			username VARCHAR(255) NOT NULL,
+			attributes TEXT NOT NULL,
+			is_direct BOOLEAN NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS service_tickets_username ON service_tickets (username)`,
+		`CREATE INDEX IF NOT EXISTS service_tickets_expires ON service_tickets (expires)`,
+		`CREATE TABLE IF NOT EXISTS proxy_granting_tickets (
+			pgt VARCHAR(255) PRIMARY KEY,
+			service TEXT NOT NULL,
+			username VARCHAR(255) NOT NULL,
+			attributes TEXT NOT NULL,
+			proxies TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS proxy_granting_tickets_username ON proxy_granting_tickets (username)`,
+		`CREATE INDEX IF NOT EXISTS proxy_granting_tickets_expires ON proxy_granting_tickets (expires)`,
+		`CREATE TABLE IF NOT EXISTS proxy_tickets (
+			ticket VARCHAR(255) PRIMARY KEY,
+			service TEXT NOT NULL,
+			username VARCHAR(255) NOT NULL,
+			attributes TEXT NOT NULL,
+			pgt VARCHAR(255) NOT NULL,
+			proxies TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS proxy_tickets_username ON proxy_tickets (username)`,
+		`CREATE INDEX IF NOT EXISTS proxy_tickets_expires ON proxy_tickets (expires)`,
+	},
+}
+
+const (
+	sqlTGTColumns           = "tgt, username, attributes, provider, id_token, sub, sid, refresh_token, refreshed_at, expires"
+	sqlServiceTicketColumns = "ticket, service, username, attributes, is_direct, expires"
+	sqlPGTColumns           = "pgt, service, username, attributes, proxies, expires"
+	sqlProxyTicketColumns   = "ticket, service, username, attributes, pgt, proxies, expires"
+)
+
+// sqlBackend names the SQL registry in its errors.
+const sqlBackend = "sql"
+
+// scanner is either a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// NewSQLRegistry migrates the schema and starts a job that deletes the expired tickets
+// every cleanupInterval.
+func NewSQLRegistry(db *sql.DB, cleanupInterval time.Duration) (*SQLRegistry, error) {
+	r := &SQLRegistry{db: db, stop: make(chan struct{})}
+	if err := r.migrate(); err != nil {
+		return nil, err
+	}
+
+	if cleanupInterval > 0 {
+		r.stopped.Add(1)
+		go r.cleanupEvery(cleanupInterval)
+	}
+
+	return r, nil
+}
+
+func (r *SQLRegistry) CreateTGT(ticket *TicketGrantingTicket) error {
+	attributes, err := json.Marshal(ticket.Attributes)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	_, err = r.db.ExecContext(ctx, `INSERT INTO ticket_granting_tickets (`+sqlTGTColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		ticket.TGT, ticket.Username, string(attributes), ticket.Provider, ticket.IDToken, ticket.Subject,
+		ticket.SessionID, ticket.RefreshToken, ticket.RefreshedAt.UnixMilli(), ticket.Expires.UnixMilli())
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) ValidateTGT(tgt string) (*TicketGrantingTicket, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlTGTColumns+` FROM ticket_granting_tickets
+		WHERE tgt = $1 AND expires >= $2`, tgt, nowMilli())
+	return scanTGT(row)
+}
+
+func (r *SQLRegistry) UpdateTGTRefresh(tgt, refreshToken string, refreshedAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE ticket_granting_tickets SET refresh_token = $1, refreshed_at = $2
+		WHERE tgt = $3`, refreshToken, refreshedAt.UnixMilli(), tgt)
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) DeleteTGT(tgt string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM ticket_granting_tickets WHERE tgt = $1`, tgt)
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) DeleteTGTsBySession(provider, sub, sid string) (int64, error) {
+	if sub == "" && sid == "" {
+		return 0, nil
+	}
+
+	query := `DELETE FROM ticket_granting_tickets WHERE provider = $1`
+	args := []interface{}{provider}
+	if sub != "" {
+		args = append(args, sub)
+		query += ` AND sub = $2`
+	}
+	if sid != "" {
+		args = append(args, sid)
+		query += ` AND sid = $` + strconv.Itoa(len(args))
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, sqlError(err)
+	}
+	deleted, err := result.RowsAffected()
+	return deleted, sqlError(err)
+}
+
+func (r *SQLRegistry) ListTGTs(username string) ([]*TicketGrantingTicket, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqlTGTColumns+` FROM ticket_granting_tickets
+		WHERE username = $1 AND expires >= $2`, username, nowMilli())
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var results []*TicketGrantingTicket
+	for rows.Next() {
+		ticket, err := scanTGT(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ticket)
+	}
+	return results, sqlError(rows.Err())
+}
+
+func (r *SQLRegistry) CreateServiceTicket(ticket *ServiceTicket) error {
+	attributes, err := json.Marshal(ticket.Attributes)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	_, err = r.db.ExecContext(ctx, `INSERT INTO service_tickets (`+sqlServiceTicketColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		ticket.Ticket, ticket.Service, ticket.Username, string(attributes), ticket.IsDirect, ticket.Expires.UnixMilli())
+	return sqlError(err)
+}
+
+// ConsumeServiceTicket reads and deletes the ticket in one transaction. Only the validator whose
+// delete removed the row gets the ticket, so two racing validations cannot both succeed.
+// The ticket is deleted before its service is compared, so a wrong service invalidates it too.
+func (r *SQLRegistry) ConsumeServiceTicket(st, service string) (*ServiceTicket, error) {
+	var result *ServiceTicket
+	err := r.consume(`DELETE FROM service_tickets WHERE ticket = $1`, st, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `SELECT `+sqlServiceTicketColumns+` FROM service_tickets
+			WHERE ticket = $1 AND expires >= $2`, st, nowMilli())
+		var err error
+		result, err = scanServiceTicket(row)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Service != service {
+		return nil, ErrTicketNotFound
+	}
+	return result, nil
+}
+
+func (r *SQLRegistry) DeleteServiceTicket(st string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM service_tickets WHERE ticket = $1`, st)
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) ListServiceTickets(username string) ([]*ServiceTicket, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqlServiceTicketColumns+` FROM service_tickets
+		WHERE username = $1 AND expires >= $2`, username, nowMilli())
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var results []*ServiceTicket
+	for rows.Next() {
+		ticket, err := scanServiceTicket(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ticket)
+	}
+	return results, sqlError(rows.Err())
+}
+
+func (r *SQLRegistry) CreatePGT(ticket *ProxyGrantingTicket) error {
+	attributes, err := json.Marshal(ticket.Attributes)
+	if err != nil {
+		return sqlError(err)
+	}
+	proxies, err := json.Marshal(ticket.Proxies)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	_, err = r.db.ExecContext(ctx, `INSERT INTO proxy_granting_tickets (`+sqlPGTColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		ticket.PGT, ticket.Service, ticket.Username, string(attributes), string(proxies), ticket.Expires.UnixMilli())
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) ValidatePGT(pgt string) (*ProxyGrantingTicket, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlPGTColumns+` FROM proxy_granting_tickets
+		WHERE pgt = $1 AND expires >= $2`, pgt, nowMilli())
+	return scanPGT(row)
+}
+
+func (r *SQLRegistry) DeletePGT(pgt string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM proxy_granting_tickets WHERE pgt = $1`, pgt)
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) ListPGTs(username string) ([]*ProxyGrantingTicket, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqlPGTColumns+` FROM proxy_granting_tickets
+		WHERE username = $1 AND expires >= $2`, username, nowMilli())
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var results []*ProxyGrantingTicket
+	for rows.Next() {
+		ticket, err := scanPGT(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ticket)
+	}
+	return results, sqlError(rows.Err())
+}
+
+func (r *SQLRegistry) CreateProxyTicket(ticket *ProxyTicket) error {
+	attributes, err := json.Marshal(ticket.Attributes)
+	if err != nil {
+		return sqlError(err)
+	}
+	proxies, err := json.Marshal(ticket.Proxies)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	_, err = r.db.ExecContext(ctx, `INSERT INTO proxy_tickets (`+sqlProxyTicketColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		ticket.Ticket, ticket.Service, ticket.Username, string(attributes), ticket.PGT, string(proxies),
+		ticket.Expires.UnixMilli())
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) ConsumeProxyTicket(pt, service string) (*ProxyTicket, error) {
+	var result *ProxyTicket
+	err := r.consume(`DELETE FROM proxy_tickets WHERE ticket = $1`, pt, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `SELECT `+sqlProxyTicketColumns+` FROM proxy_tickets
+			WHERE ticket = $1 AND expires >= $2`, pt, nowMilli())
+		var err error
+		result, err = scanProxyTicket(row)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Service != service {
+		return nil, ErrTicketNotFound
+	}
+	return result, nil
+}
+
+func (r *SQLRegistry) DeleteProxyTicket(pt string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM proxy_tickets WHERE ticket = $1`, pt)
+	return sqlError(err)
+}
+
+func (r *SQLRegistry) ListProxyTickets(username string) ([]*ProxyTicket, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqlProxyTicketColumns+` FROM proxy_tickets
+		WHERE username = $1 AND expires >= $2`, username, nowMilli())
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var results []*ProxyTicket
+	for rows.Next() {
+		ticket, err := scanProxyTicket(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ticket)
+	}
+	return results, sqlError(rows.Err())
+}
+
+func (r *SQLRegistry) Ping(ctx context.Context) error {
+	return sqlError(r.db.PingContext(ctx))
+}
+
+// Close stops the cleanup job and closes the database.
+func (r *SQLRegistry) Close(ctx context.Context) error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.stopped.Wait()
+		err = r.db.Close()
+	})
+	return sqlError(err)
+}
+
+// Cleanup deletes the expired tickets.
+func (r *SQLRegistry) Cleanup() error {
+	now := nowMilli()
+	for _, table := range []string{"ticket_granting_tickets", "service_tickets", "proxy_granting_tickets", "proxy_tickets"} {
+		if _, err := r.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires < $1`, now); err != nil {
+			return sqlError(err)
+		}
+	}
+	return nil
+}
+
+func (r *SQLRegistry) cleanupEvery(interval time.Duration) {
+	defer r.stopped.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Cleanup(); err != nil {
+				log.Printf("Error deleting expired tickets: %v", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// consume runs find and then deleteQuery on the ticket in one transaction, and fails with
+// ErrTicketNotFound if another transaction deleted the ticket first.
+func (r *SQLRegistry) consume(deleteQuery, ticket string, find func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	if err := find(tx); err != nil {
+		return sqlError(err)
+	}
+
+	result, err := tx.ExecContext(ctx, deleteQuery, ticket)
+	if err != nil {
+		return sqlError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return sqlError(err)
+	}
+	if deleted == 0 {
+		return ErrTicketNotFound
+	}
+
+	return sqlError(tx.Commit())
+}
+
+// migrate applies the migrations that are not recorded yet. Several servers may start at once,
+// so a migration that fails is accepted if another server recorded it meanwhile.
+func (r *SQLRegistry) migrate() error {
+	if _, err := r.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	for i, statements := range sqlMigrations {
+		version := i + 1
+		applied, err := r.migrationApplied(version)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		if err := r.applyMigration(version, statements); err != nil {
+			if applied, _ := r.migrationApplied(version); !applied {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *SQLRegistry) migrationApplied(version int) (bool, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations WHERE version = $1`, version).Scan(&count)
+	return count > 0, err
+}
+
+func (r *SQLRegistry) applyMigration(version int, statements []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func scanTGT(row scanner) (*TicketGrantingTicket, error) {
+	var ticket TicketGrantingTicket
+	var attributes string
+	var refreshedAt, expires int64
+	err := row.Scan(&ticket.TGT, &ticket.Username, &attributes, &ticket.Provider, &ticket.IDToken, &ticket.Subject,
+		&ticket.SessionID, &ticket.RefreshToken, &refreshedAt, &expires)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	if err := json.Unmarshal([]byte(attributes), &ticket.Attributes); err != nil {
+		return nil, sqlError(err)
+	}
+	ticket.RefreshedAt, ticket.Expires = time.UnixMilli(refreshedAt), time.UnixMilli(expires)
+	return &ticket, nil
+}
+
+func scanServiceTicket(row scanner) (*ServiceTicket, error) {
+	var ticket ServiceTicket
+	var attributes string
+	var expires int64
+	err := row.Scan(&ticket.Ticket, &ticket.Service, &ticket.Username, &attributes, &ticket.IsDirect, &expires)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	if err := json.Unmarshal([]byte(attributes), &ticket.Attributes); err != nil {
+		return nil, sqlError(err)
+	}
+	ticket.Expires = time.UnixMilli(expires)
+	return &ticket, nil
+}
+
+func scanPGT(row scanner) (*ProxyGrantingTicket, error) {
+	var ticket ProxyGrantingTicket
+	var attributes, proxies string
+	var expires int64
+	err := row.Scan(&ticket.PGT, &ticket.Service, &ticket.Username, &attributes, &proxies, &expires)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	if err := json.Unmarshal([]byte(attributes), &ticket.Attributes); err != nil {
+		return nil, sqlError(err)
+	}
+	if err := json.Unmarshal([]byte(proxies), &ticket.Proxies); err != nil {
+		return nil, sqlError(err)
+	}
+	ticket.Expires = time.UnixMilli(expires)
+	return &ticket, nil
+}
+
+func scanProxyTicket(row scanner) (*ProxyTicket, error) {
+	var ticket ProxyTicket
+	var attributes, proxies string
+	var expires int64
+	err := row.Scan(&ticket.Ticket, &ticket.Service, &ticket.Username, &attributes, &ticket.PGT, &proxies, &expires)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	if err := json.Unmarshal([]byte(attributes), &ticket.Attributes); err != nil {
+		return nil, sqlError(err)
+	}
+	if err := json.Unmarshal([]byte(proxies), &ticket.Proxies); err != nil {
+		return nil, sqlError(err)
+	}
+	ticket.Expires = time.UnixMilli(expires)
+	return &ticket, nil
+}
+
+// sqlError turns a missing row into ErrTicketNotFound and wraps the other errors in a RegistryError.
+func sqlError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTicketNotFound
+	}
+	return registryError(sqlBackend, err)
+}
+
+func nowMilli() int64 {
+	return time.Now().UnixMilli()
+}
@@ -1,12 +1,21 @@
 package auth
 
 import (
+	"context"
+
 	"github.com/gin-gonic/gin"
 	"golang.org/x/oauth2"
 )
 
 type Authenticator interface {
-	Authenticate(username, password string) bool
-	RedirectAuth(c *gin.Context)
-	Exchange(c *gin.Context, code string) (*oauth2.Token, error)
+	Authenticate(ctx context.Context, username, password string) (*oauth2.Token, error)
+	RedirectAuth(c *gin.Context, authRequest *AuthRequest)
+	UsesFormPost() bool
+	Available() bool
+	Exchange(c *gin.Context, code string, authRequest *AuthRequest) (*oauth2.Token, error)
+	Refresh(ctx context.Context, refreshToken string) (*oauth2.Token, error)
+	VerifyToken(token *oauth2.Token, authRequest *AuthRequest) (map[string]interface{}, error)
+	UserInfo(ctx context.Context, token *oauth2.Token, claims map[string]interface{}) (map[string]interface{}, error)
+	LogoutURL(idToken, postLogoutRedirectURI string) string
+	VerifyLogoutToken(rawLogoutToken string, logout func(sub, sid string) error) error
 }
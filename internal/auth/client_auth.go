@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"bytes"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/internal/utils"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+)
+
+// clientAssertionLifetime is how long a signed client assertion is accepted by the provider.
+var clientAssertionLifetime = 1 * time.Minute
+
+// KeySigner signs JWTs, such as the private_key_jwt client assertions of RFC 7523, with a PEM key file.
+// The file is read again when it changes, so the key can be rotated without a restart. The key ID
+// sent in the header is KeyID or, when empty, the RFC 7638 thumbprint of the key, which follows rotations.
+type KeySigner struct {
+	KeyFile string
+	KeyID   string
+
+	mutex   sync.Mutex
+	key     crypto.Signer
+	kid     string
+	method  jwt.SigningMethod
+	modTime time.Time
+}
+
+func NewKeySigner(keyFile, keyID string) (*KeySigner, error) {
+	signer := &KeySigner{KeyFile: keyFile, KeyID: keyID}
+	if _, _, _, err := signer.currentKey(); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// Sign returns the claims signed with the current key.
+func (s *KeySigner) Sign(claims jwt.MapClaims) (string, error) {
+	key, kid, method, err := s.currentKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	return token.SignedString(key)
+}
+
+// signedClaims returns the claims every JWT the client sends has: issuer, audience, ID and lifetime.
+func signedClaims(issuer, audience string, lifetime time.Duration) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss": issuer,
+		"aud": audience,
+		"jti": utils.RandomString(16),
+		"iat": now.Unix(),
+		"exp": now.Add(lifetime).Unix(),
+	}
+}
+
+// currentKey returns the signing key, reading the key file again when it was modified.
+func (s *KeySigner) currentKey() (crypto.Signer, string, jwt.SigningMethod, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info, err := os.Stat(s.KeyFile)
+	if err != nil {
+		if s.key != nil {
+			return s.key, s.kid, s.method, nil
+		}
+		return nil, "", nil, err
+	}
+
+	if s.key != nil && info.ModTime().Equal(s.modTime) {
+		return s.key, s.kid, s.method, nil
+	}
+
+	key, method, err := readPrivateKey(s.KeyFile)
+	if err != nil {
+		if s.key != nil {
+			// A file being replaced may be read half written, keep the previous key until it is complete
+			return s.key, s.kid, s.method, nil
+		}
+		return nil, "", nil, err
+	}
+
+	kid := s.KeyID
+	if kid == "" {
+		if kid, err = thumbprint(key.Public()); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	s.key, s.kid, s.method, s.modTime = key, kid, method, info.ModTime()
+	return s.key, s.kid, s.method, nil
+}
+
+func readPrivateKey(keyFile string) (crypto.Signer, jwt.SigningMethod, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf(constants.AUTH_ERRMSG_CLIENT_KEY, keyFile)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return k, jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return k, jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return k, jwt.SigningMethodES512, nil
+		}
+	}
+	return nil, nil, fmt.Errorf(constants.AUTH_ERRMSG_CLIENT_KEY, keyFile)
+}
+
+// thumbprint returns the RFC 7638 JWK thumbprint of a public key.
+func thumbprint(key crypto.PublicKey) (string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	var members interface{}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{encode(bigEndian(int64(k.E))), "RSA", encode(k.N.Bytes())}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Curve.Params().Name, "EC", encode(k.X.FillBytes(make([]byte, size))), encode(k.Y.FillBytes(make([]byte, size)))}
+	default:
+		return "", fmt.Errorf(constants.AUTH_ERRMSG_KEY_TYPE, fmt.Sprintf("%T", key))
+	}
+
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return encode(sum[:]), nil
+}
+
+func bigEndian(value int64) []byte {
+	var encoded []byte
+	for ; value > 0; value >>= 8 {
+		encoded = append([]byte{byte(value)}, encoded...)
+	}
+	return encoded
+}
+
+// ClientAssertionTransport adds a private_key_jwt client assertion to the form requests that
+// authenticate the client with its client_id, such as the token endpoint requests.
+type ClientAssertionTransport struct {
+	Base     http.RoundTripper
+	ClientID string
+	Signer   *KeySigner
+}
+
+func (t *ClientAssertionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if req.Method != http.MethodPost || req.Body == nil ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get(constants.AUTH_CLIENT_ID_PARAM) != t.ClientID || form.Has(constants.AUTH_CLIENT_ASSERTION_PARAM) {
+		return base.RoundTrip(cloneWithBody(req, body))
+	}
+
+	audience := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: req.URL.Path}
+	claims := signedClaims(t.ClientID, audience.String(), clientAssertionLifetime)
+	claims["sub"] = t.ClientID
+	assertion, err := t.Signer.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	form.Del(constants.AUTH_CLIENT_SECRET_PARAM)
+	form.Set(constants.AUTH_CLIENT_ASSERTION_TYPE_PARAM, constants.AUTH_CLIENT_ASSERTION_TYPE_JWT)
+	form.Set(constants.AUTH_CLIENT_ASSERTION_PARAM, assertion)
+
+	return base.RoundTrip(cloneWithBody(req, []byte(form.Encode())))
+}
+
+// cloneWithBody returns a copy of the request with a new body, RoundTrippers must not modify the request.
+func cloneWithBody(req *http.Request, body []byte) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	clone.ContentLength = int64(len(body))
+	clone.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return clone
+}
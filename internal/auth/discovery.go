@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProviderMetadata holds the endpoints published by an OpenID Connect provider
+// in its /.well-known/openid-configuration document.
+type ProviderMetadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	EndSessionEndpoint    string   `json:"end_session_endpoint"`
+	PAREndpoint           string   `json:"pushed_authorization_request_endpoint"`
+	ScopesSupported       []string `json:"scopes_supported"`
+}
+
+// FetchProviderMetadata downloads and validates the discovery document of the issuer.
+func FetchProviderMetadata(client *http.Client, issuer string) (*ProviderMetadata, error) {
+	discoveryURL := strings.TrimSuffix(issuer, "/") + constants.AUTH_DISCOVERY_PATH
+	resp, err := client.Get(discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_DISCOVERY_STATUS, resp.StatusCode)
+	}
+
+	var metadata ProviderMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, err
+	}
+
+	if err := metadata.validate(issuer); err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+func (m *ProviderMetadata) validate(issuer string) error {
+	if m.Issuer != issuer {
+		return fmt.Errorf(constants.AUTH_ERRMSG_DISCOVERY_ISSUER, m.Issuer)
+	}
+
+	required := map[string]string{
+		"authorization_endpoint": m.AuthorizationEndpoint,
+		"token_endpoint":         m.TokenEndpoint,
+		"jwks_uri":               m.JWKSURI,
+	}
+	for name, value := range required {
+		if value == "" {
+			return fmt.Errorf(constants.AUTH_ERRMSG_DISCOVERY_FIELD, name)
+		}
+	}
+
+	return nil
+}
+
+// UnsupportedScopes returns the scopes the provider does not list in scopes_supported.
+// The list is optional and not always complete, so nothing is reported without it.
+func (m *ProviderMetadata) UnsupportedScopes(scopes []string) []string {
+	if len(m.ScopesSupported) == 0 {
+		return nil
+	}
+
+	supported := make(map[string]bool, len(m.ScopesSupported))
+	for _, scope := range m.ScopesSupported {
+		supported[scope] = true
+	}
+
+	var unsupported []string
+	for _, scope := range scopes {
+		if !supported[scope] {
+			unsupported = append(unsupported, scope)
+		}
+	}
+	return unsupported
+}
+
+// Discover fetches the provider metadata of the issuer and applies its endpoints.
+// The userinfo, end session and PAR endpoints set in the configuration are kept.
+func (o *OAuth2Authenticator) Discover(issuer string) error {
+	metadata, err := FetchProviderMetadata(o.httpClient(), issuer)
+	if err != nil {
+		return err
+	}
+
+	o.mutex.Lock()
+	previous := o.Metadata
+	if previous == nil {
+		previous = &ProviderMetadata{}
+	}
+	o.Config.Endpoint.AuthURL = metadata.AuthorizationEndpoint
+	o.Config.Endpoint.TokenURL = metadata.TokenEndpoint
+	o.Metadata = metadata
+	o.UserInfoURL = discoveredURL(o.UserInfoURL, previous.UserinfoEndpoint, metadata.UserinfoEndpoint)
+	o.EndSessionURL = discoveredURL(o.EndSessionURL, previous.EndSessionEndpoint, metadata.EndSessionEndpoint)
+	o.PARURL = discoveredURL(o.PARURL, previous.PAREndpoint, metadata.PAREndpoint)
+	o.mutex.Unlock()
+
+	o.Verifier.Keys.SetURL(metadata.JWKSURI)
+	return nil
+}
+
+// discoveredURL returns the endpoint to use after a discovery. The current one is kept when it
+// was configured, that is set but not by the previous discovery, or when none is published.
+func discoveredURL(current, previous, published string) string {
+	if published == "" || (current != "" && current != previous) {
+		return current
+	}
+	return published
+}
+
+// WatchDiscovery fetches the provider metadata again on every interval. Failures are logged
+// and the last known metadata is kept.
+func (o *OAuth2Authenticator) WatchDiscovery(issuer string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := o.Discover(issuer); err != nil {
+			log.Printf("Error refreshing OIDC discovery document: %v", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// newDiscoveryServer returns a provider whose discovery document has the endpoints of the
+// returned function, called again for every request.
+func newDiscoveryServer(t *testing.T, endpoints func(issuer string) map[string]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		document := map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		}
+		for name, value := range endpoints(server.URL) {
+			document[name] = value
+		}
+		_ = json.NewEncoder(w).Encode(document)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDiscoverKeepsConfiguredEndpoints(t *testing.T) {
+	version := "v1"
+	server := newDiscoveryServer(t, func(issuer string) map[string]string {
+		return map[string]string{
+			"userinfo_endpoint":                     issuer + "/" + version + "/userinfo",
+			"end_session_endpoint":                  issuer + "/" + version + "/logout",
+			"pushed_authorization_request_endpoint": issuer + "/" + version + "/par",
+		}
+	})
+
+	authenticator := NewOAuth2Authenticator(oauth2.Config{ClientID: testClientID}, NewIDTokenVerifier(server.URL, testClientID, nil, 0, NewKeySet("")))
+	authenticator.PARURL = "https://gateway.example.edu/par"
+
+	for _, version = range []string{"v1", "v2"} {
+		// The refresh follows the published endpoints that were not configured
+		if err := authenticator.Discover(server.URL); err != nil {
+			t.Fatal(err)
+		}
+		if authenticator.PARURL != "https://gateway.example.edu/par" {
+			t.Fatalf("%s: configured PAR endpoint replaced by %q", version, authenticator.PARURL)
+		}
+		if want := server.URL + "/" + version + "/userinfo"; authenticator.UserInfoURL != want {
+			t.Fatalf("%s: userinfo endpoint is %q, want %q", version, authenticator.UserInfoURL, want)
+		}
+		if want := server.URL + "/" + version + "/logout"; authenticator.EndSessionURL != want {
+			t.Fatalf("%s: end session endpoint is %q, want %q", version, authenticator.EndSessionURL, want)
+		}
+	}
+}
+
+func TestUnsupportedScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		supported []string
+		scopes    []string
+		want      []string
+	}{
+		{"every scope supported", []string{"openid", "profile", "email"}, []string{"openid", "email"}, nil},
+		{"unsupported scopes in order", []string{"openid", "email"}, []string{"groups", "openid", "offline_access"}, []string{"groups", "offline_access"}},
+		{"scopes are case sensitive", []string{"openid", "email"}, []string{"openid", "Email"}, []string{"Email"}},
+		{"no scopes_supported", nil, []string{"openid", "groups"}, nil},
+		{"no scopes requested", []string{"openid"}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := &ProviderMetadata{ScopesSupported: tt.supported}
+			if got := metadata.UnsupportedScopes(tt.scopes); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("UnsupportedScopes(%v) = %v, want %v", tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the provider while it is considered down.
+var ErrCircuitOpen = errors.New(constants.AUTH_ERRMSG_CIRCUIT_OPEN)
+
+// NewTransport returns the base transport of the requests to a provider. caFile adds a PEM bundle
+// to the system roots, proxyURL replaces the proxy of the environment, and timeout bounds
+// connecting and waiting for the response headers.
+func NewTransport(caFile, proxyURL string, timeout time.Duration) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf(constants.AUTH_ERRMSG_CA_FILE, caFile)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return transport, nil
+}
+
+// AddClientCertificate makes the transport present the client certificate for tls_client_auth.
+func AddClientCertificate(transport *http.Transport, certFile, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	return nil
+}
+
+// RetryTransport sends a request again, up to Retries times, when it failed for a reason that is
+// likely temporary. Idempotent requests are retried on network errors and 502, 503 and 504 responses,
+// the rest only when the connection could not be opened, so the provider never saw them.
+type RetryTransport struct {
+	Base    http.RoundTripper
+	Retries int
+	Backoff time.Duration
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := t.Base.RoundTrip(attemptReq)
+		if attempt >= t.Retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if attemptReq, err = rewind(req); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(t.Backoff * time.Duration(attempt+1)):
+		}
+	}
+}
+
+// TotalBackoff is the longest time a request waits between its attempts.
+func (t *RetryTransport) TotalBackoff() time.Duration {
+	return t.Backoff * time.Duration(t.Retries*(t.Retries+1)/2)
+}
+
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if err != nil {
+		var opErr *net.OpError
+		return req.Context().Err() == nil && (idempotent || errors.As(err, &opErr) && opErr.Op == "dial")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// rewind returns a copy of the request with its body read again from the start.
+func rewind(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+// CircuitBreaker stops calling a provider after MaxFailures consecutive failed requests, network errors
+// or 5xx responses, and fails fast with ErrCircuitOpen. After OpenTimeout a single request is let through
+// to probe the provider, which closes the circuit again when it succeeds. MaxFailures 0 disables it.
+type CircuitBreaker struct {
+	Base        http.RoundTripper
+	MaxFailures int
+	OpenTimeout time.Duration
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Available reports whether requests are being sent to the provider.
+func (b *CircuitBreaker) Available() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !b.isOpen() || (!b.probing && time.Since(b.openedAt) >= b.OpenTimeout)
+}
+
+func (b *CircuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !b.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	resp, err := b.Base.RoundTrip(req)
+
+	// Requests canceled by the caller say nothing about the provider
+	if err != nil && req.Context().Err() != nil {
+		b.release()
+		return resp, err
+	}
+
+	b.record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
+
+func (b *CircuitBreaker) isOpen() bool {
+	return b.MaxFailures > 0 && b.failures >= b.MaxFailures
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.isOpen() {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.OpenTimeout {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// release frees the probe slot of a request that ended without an answer from the provider,
+// leaving the state of the circuit as it was.
+func (b *CircuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+func (b *CircuitBreaker) record(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wasProbing := b.probing
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures == b.MaxFailures || wasProbing {
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerCycle(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	calls := 0
+	breaker := &CircuitBreaker{
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return response(status), nil
+		}),
+		MaxFailures: 2,
+		OpenTimeout: 20 * time.Millisecond,
+	}
+	get := func() error {
+		req, _ := http.NewRequest(http.MethodGet, "https://idp.example.edu/token", nil)
+		_, err := breaker.RoundTrip(req)
+		return err
+	}
+
+	// Closed: failures are counted until the circuit opens
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if breaker.Available() {
+		t.Fatal("circuit still closed after MaxFailures failures")
+	}
+
+	// Open: the provider is not called
+	if err := get(); !errors.Is(err, ErrCircuitOpen) || calls != 2 {
+		t.Fatalf("got %v after %d calls, want ErrCircuitOpen without calling the provider", err, calls)
+	}
+
+	// Half open: a failed probe opens the circuit again
+	time.Sleep(25 * time.Millisecond)
+	if !breaker.Available() {
+		t.Fatal("no probe allowed after OpenTimeout")
+	}
+	if err := get(); err != nil || calls != 3 {
+		t.Fatalf("probe: %v after %d calls", err, calls)
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v after a failed probe, want ErrCircuitOpen", err)
+	}
+
+	// Half open: a successful probe closes the circuit
+	time.Sleep(25 * time.Millisecond)
+	status = http.StatusOK
+	if err := get(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if !breaker.Available() {
+		t.Fatal("circuit still open after a successful probe")
+	}
+	if err := get(); err != nil || calls != 5 {
+		t.Fatalf("got %v after %d calls, want the provider called", err, calls)
+	}
+}
+
+func TestCircuitBreakerOnlyOneProbe(t *testing.T) {
+	release := make(chan struct{})
+	breaker := &CircuitBreaker{
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			<-release
+			return response(http.StatusOK), nil
+		}),
+		MaxFailures: 1,
+		OpenTimeout: time.Millisecond,
+	}
+	breaker.failures, breaker.openedAt = 1, time.Now().Add(-time.Second)
+
+	done := make(chan error)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "https://idp.example.edu/", nil)
+		_, err := breaker.RoundTrip(req)
+		done <- err
+	}()
+
+	// Wait for the probe to be in flight
+	for breaker.Available() {
+		time.Sleep(time.Millisecond)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://idp.example.edu/", nil)
+	if _, err := breaker.RoundTrip(req); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v during the probe, want ErrCircuitOpen", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCircuitBreakerIgnoresCanceledRequests(t *testing.T) {
+	breaker := &CircuitBreaker{
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}),
+		MaxFailures: 2,
+		OpenTimeout: time.Millisecond,
+	}
+	canceled := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://idp.example.edu/", nil)
+		_, _ = breaker.RoundTrip(req)
+	}
+
+	// A canceled request does not reset the failures of a closed circuit
+	breaker.failures = 1
+	canceled()
+	if breaker.failures != 1 {
+		t.Fatalf("failures is %d after a canceled request, want 1", breaker.failures)
+	}
+
+	// A canceled probe leaves the circuit open, but lets the next request probe
+	openedAt := time.Now().Add(-time.Second)
+	breaker.failures, breaker.openedAt = 2, openedAt
+	canceled()
+	if breaker.failures != 2 || !breaker.openedAt.Equal(openedAt) || breaker.probing {
+		t.Fatalf("canceled probe changed the circuit: failures %d, opened at %v, probing %v",
+			breaker.failures, breaker.openedAt, breaker.probing)
+	}
+	if !breaker.Available() {
+		t.Fatal("no probe allowed after a canceled probe")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := &CircuitBreaker{
+		Base:        roundTripFunc(func(req *http.Request) (*http.Response, error) { return nil, errors.New("down") }),
+		OpenTimeout: time.Hour,
+	}
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://idp.example.edu/", nil)
+		if _, err := breaker.RoundTrip(req); errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("circuit opened with MaxFailures 0")
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+
+	tests := []struct {
+		name      string
+		method    string
+		body      string
+		status    int
+		err       error
+		wantCalls int
+	}{
+		{"GET retried on 503", http.MethodGet, "", http.StatusServiceUnavailable, nil, 3},
+		{"GET retried on 502", http.MethodGet, "", http.StatusBadGateway, nil, 3},
+		{"GET retried on network error", http.MethodGet, "", 0, readErr, 3},
+		{"GET not retried on 500", http.MethodGet, "", http.StatusInternalServerError, nil, 1},
+		{"GET not retried on 200", http.MethodGet, "", http.StatusOK, nil, 1},
+		{"POST not retried on 503", http.MethodPost, "code=abc", http.StatusServiceUnavailable, nil, 1},
+		{"POST not retried on network error", http.MethodPost, "code=abc", 0, readErr, 1},
+		{"POST retried on dial error", http.MethodPost, "code=abc", 0, dialErr, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			transport := &RetryTransport{
+				Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					calls++
+					if req.Body != nil {
+						body, _ := io.ReadAll(req.Body)
+						if string(body) != tt.body {
+							t.Errorf("attempt %d sent body %q, want %q", calls, body, tt.body)
+						}
+					}
+					if tt.err != nil {
+						return nil, tt.err
+					}
+					return response(tt.status), nil
+				}),
+				Retries: 2,
+				Backoff: time.Millisecond,
+			}
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, _ := http.NewRequest(tt.method, "https://idp.example.edu/token", body)
+			_, _ = transport.RoundTrip(req)
+
+			if calls != tt.wantCalls {
+				t.Fatalf("sent %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryTransportStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	transport := &RetryTransport{
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			cancel()
+			return response(http.StatusServiceUnavailable), nil
+		}),
+		Retries: 2,
+		Backoff: time.Hour,
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://idp.example.edu/", nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("got %v after %d calls, want context.Canceled after 1", err, calls)
+	}
+}
+
+func TestRetryTransportTotalBackoff(t *testing.T) {
+	transport := &RetryTransport{Retries: 3, Backoff: 100 * time.Millisecond}
+	if got := transport.TotalBackoff(); got != 600*time.Millisecond {
+		t.Fatalf("total backoff is %v, want 600ms", got)
+	}
+}
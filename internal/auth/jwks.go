@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+)
+
+var (
+	// jwksMaxAge is how long a fetched key set is trusted before it is fetched again.
+	jwksMaxAge = 1 * time.Hour
+	// jwksMinRefresh limits how often an unknown key ID can trigger a new fetch.
+	jwksMinRefresh = 1 * time.Minute
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type publicKey struct {
+	alg string
+	key interface{}
+}
+
+// KeySet fetches and caches the JSON Web Key Set published by the OAuth2 provider.
+// Keys are fetched again when they get old or when a token is signed with an unknown key ID,
+// so that key rotation at the provider is picked up without a restart.
+type KeySet struct {
+	URL    string
+	Client *http.Client
+
+	mutex     sync.RWMutex
+	keys      map[string]publicKey
+	fetchedAt time.Time
+}
+
+func NewKeySet(url string) *KeySet {
+	return &KeySet{URL: url, Client: http.DefaultClient}
+}
+
+// Keyfunc returns the verification key for the given token, as required by the jwt parser.
+func (k *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	alg, _ := token.Header["alg"].(string)
+
+	key, found := k.lookup(kid)
+	if k.needsRefresh(found) {
+		// A stale key set is still better than none when the provider is unreachable
+		if err := k.refresh(); err == nil {
+			key, found = k.lookup(kid)
+		} else if !found {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_UNKNOWN_KEY, kid)
+	}
+
+	if key.alg != "" && key.alg != alg {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_KEY_ALG, alg)
+	}
+
+	return key.key, nil
+}
+
+// SetURL changes the location of the key set, for example after a new discovery document.
+func (k *KeySet) SetURL(url string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.URL != url {
+		k.URL = url
+		k.fetchedAt = time.Time{}
+	}
+}
+
+func (k *KeySet) lookup(kid string) (publicKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, found := k.keys[kid]
+	return key, found
+}
+
+func (k *KeySet) needsRefresh(found bool) bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	age := time.Since(k.fetchedAt)
+	if !found {
+		return age > jwksMinRefresh
+	}
+	return age > jwksMaxAge
+}
+
+func (k *KeySet) refresh() error {
+	k.mutex.RLock()
+	url := k.URL
+	k.mutex.RUnlock()
+
+	resp, err := k.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(constants.AUTH_ERRMSG_JWKS_STATUS, resp.StatusCode)
+	}
+
+	var body struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	keys := make(map[string]publicKey)
+	for _, jwk := range body.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = publicKey{alg: jwk.Alg, key: key}
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.keys = keys
+	k.fetchedAt = time.Now()
+	return nil
+}
+
+func (j jsonWebKey) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf(constants.AUTH_ERRMSG_KEY_TYPE, j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_KEY_TYPE, j.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeySetRefreshesUnknownKeyOnce(t *testing.T) {
+	first := newRSAKey(t, "key-1")
+	rotated := newRSAKey(t, "key-2")
+	server := newJWKSServer(t, first)
+	verifier := NewIDTokenVerifier(testIssuer, testClientID, []string{"RS256"}, time.Minute, NewKeySet(server.URL))
+
+	if _, err := verifier.Verify(first.sign(t, idTokenClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.requestCount(); got != 1 {
+		t.Fatalf("fetched the JWKS %d times, want 1", got)
+	}
+
+	// A token with an unknown kid right after a fetch does not fetch again
+	server.setKeys(first, rotated)
+	if _, err := verifier.Verify(rotated.sign(t, idTokenClaims())); err == nil {
+		t.Fatal("token with an unknown kid accepted before the key set was refreshed")
+	}
+	if got := server.requestCount(); got != 1 {
+		t.Fatalf("fetched the JWKS %d times within jwksMinRefresh, want 1", got)
+	}
+
+	// Once jwksMinRefresh has passed, the unknown kid triggers a single refresh
+	verifier.Keys.fetchedAt = time.Now().Add(-jwksMinRefresh - time.Second)
+	if _, err := verifier.Verify(rotated.sign(t, idTokenClaims())); err != nil {
+		t.Fatalf("rotated key not picked up: %v", err)
+	}
+	if _, err := verifier.Verify(rotated.sign(t, idTokenClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.requestCount(); got != 2 {
+		t.Fatalf("fetched the JWKS %d times, want 2", got)
+	}
+}
+
+func TestKeySetUsesStaleKeysWhenFetchFails(t *testing.T) {
+	key := newECKey(t, "key-1")
+	server := newJWKSServer(t, key)
+	verifier := NewIDTokenVerifier(testIssuer, testClientID, []string{"ES256"}, time.Minute, NewKeySet(server.URL))
+
+	if _, err := verifier.Verify(key.sign(t, idTokenClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached keys are old and the provider is down: they are still used
+	server.setFailing(true)
+	verifier.Keys.fetchedAt = time.Now().Add(-jwksMaxAge - time.Second)
+	if _, err := verifier.Verify(key.sign(t, idTokenClaims())); err != nil {
+		t.Fatalf("stale key not used while the JWKS endpoint fails: %v", err)
+	}
+	if got := server.requestCount(); got != 2 {
+		t.Fatalf("fetched the JWKS %d times, want 2", got)
+	}
+
+	// Without any cached key the failure is reported
+	unknown := newECKey(t, "key-2")
+	verifier.Keys.fetchedAt = time.Now().Add(-jwksMinRefresh - time.Second)
+	if _, err := verifier.Verify(unknown.sign(t, idTokenClaims())); err == nil {
+		t.Fatal("token with an unknown kid accepted while the JWKS endpoint fails")
+	}
+}
+
+func TestKeySetWithoutKid(t *testing.T) {
+	key := newRSAKey(t, "")
+	server := newJWKSServer(t, key)
+	verifier := NewIDTokenVerifier(testIssuer, testClientID, []string{"RS256"}, time.Minute, NewKeySet(server.URL))
+
+	// A token without kid is verified with the only key of the set
+	if _, err := verifier.Verify(key.sign(t, idTokenClaims())); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go/v4"
+)
+
+// LogoutURL returns the end_session_endpoint URL that logs the user out of the provider too,
+// or an empty string when upstream logout is disabled or not supported by the provider.
+// When postLogoutRedirectURI is empty the configured default is used.
+func (o *OAuth2Authenticator) LogoutURL(idToken, postLogoutRedirectURI string) string {
+	o.mutex.RLock()
+	endSessionURL := o.EndSessionURL
+	o.mutex.RUnlock()
+
+	if !o.UpstreamLogout || endSessionURL == "" {
+		return ""
+	}
+
+	logoutURL, err := url.Parse(endSessionURL)
+	if err != nil {
+		return ""
+	}
+
+	if postLogoutRedirectURI == "" {
+		postLogoutRedirectURI = o.PostLogoutRedirectURL
+	}
+
+	query := logoutURL.Query()
+	query.Set(constants.AUTH_CLIENT_ID_PARAM, o.oauth2Config().ClientID)
+	if idToken != "" {
+		query.Set(constants.AUTH_ID_TOKEN_HINT_PARAM, idToken)
+	}
+	if postLogoutRedirectURI != "" {
+		query.Set(constants.AUTH_POST_LOGOUT_REDIRECT_PARAM, postLogoutRedirectURI)
+	}
+	logoutURL.RawQuery = query.Encode()
+
+	return logoutURL.String()
+}
+
+// usedLogoutTokens holds the issuer and jti of the logout tokens already accepted, until they expire.
+var usedLogoutTokens = NewReplayCache()
+
+// VerifyLogoutToken verifies an OpenID Connect Back-Channel Logout token and calls logout with
+// the subject and the session ID it refers to. At least one of them is not empty.
+// The token must be typed logout+jwt, so no other token of the provider is taken for one,
+// and each token is accepted only once. A token whose logout failed is not used up, so the
+// provider can send it again; the error of logout is returned as is.
+func (o *OAuth2Authenticator) VerifyLogoutToken(rawLogoutToken string, logout func(sub, sid string) error) error {
+	claims, err := o.Verifier.Verify(rawLogoutToken)
+	if err != nil {
+		return err
+	}
+
+	token, _, err := jwt.NewParser().ParseUnverified(rawLogoutToken, jwt.MapClaims{})
+	if err != nil {
+		return err
+	}
+	tokenType, _ := token.Header[constants.AUTH_TYPE_HEADER].(string)
+	if tokenType := strings.TrimPrefix(strings.ToLower(tokenType), "application/"); tokenType != constants.AUTH_LOGOUT_TOKEN_TYPE {
+		return fmt.Errorf(constants.AUTH_ERRMSG_LOGOUT_TYPE, tokenType)
+	}
+
+	events, _ := claims[constants.AUTH_EVENTS_CLAIM].(map[string]interface{})
+	if _, ok := events[constants.AUTH_BACKCHANNEL_LOGOUT_EVENT].(map[string]interface{}); !ok {
+		return fmt.Errorf(constants.AUTH_ERRMSG_LOGOUT_EVENT)
+	}
+
+	if _, ok := claims[constants.AUTH_NONCE_PARAM]; ok {
+		return fmt.Errorf(constants.AUTH_ERRMSG_LOGOUT_NONCE)
+	}
+
+	sub, _ := claims[constants.AUTH_SUBJECT_CLAIM].(string)
+	sid, _ := claims[constants.AUTH_SESSION_ID_CLAIM].(string)
+	if sub == "" && sid == "" {
+		return fmt.Errorf(constants.AUTH_ERRMSG_LOGOUT_SUBJECT)
+	}
+
+	jti, _ := claims[constants.AUTH_JTI_CLAIM].(string)
+	if jti == "" {
+		return fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_MISSING, constants.AUTH_JTI_CLAIM)
+	}
+	expires, err := claims.LoadTimeValue(constants.AUTH_EXPIRES_CLAIM)
+	if err != nil || expires == nil {
+		return fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_INVALID, constants.AUTH_EXPIRES_CLAIM)
+	}
+	issuer, _ := claims[constants.AUTH_ISSUER_CLAIM].(string)
+	usedToken := issuer + " " + jti
+	if !usedLogoutTokens.Use(usedToken, expires.Add(o.Verifier.ClockSkew)) {
+		return fmt.Errorf(constants.AUTH_ERRMSG_LOGOUT_REPLAYED, jti)
+	}
+
+	// The jti is held while logging out, so a concurrent replay is still rejected
+	if err := logout(sub, sid); err != nil {
+		usedLogoutTokens.Release(usedToken)
+		return err
+	}
+	return nil
+}
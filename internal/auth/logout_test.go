@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go/v4"
+)
+
+// signLogoutToken signs the claims with the given typ header, or none when it is empty.
+func signLogoutToken(t *testing.T, key testKey, typ string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	if typ == "" {
+		delete(token.Header, "typ")
+	} else {
+		token.Header["typ"] = typ
+	}
+
+	signed, err := token.SignedString(key.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifyLogoutToken(t *testing.T) {
+	key := newRSAKey(t, "key-1")
+	authenticator := newTestAuthenticator(t, key)
+
+	var counter int
+	logoutClaims := func(changes jwt.MapClaims) jwt.MapClaims {
+		counter++
+		claims := idTokenClaims()
+		claims["sid"] = "session-1"
+		claims["jti"] = fmt.Sprintf("logout-%d", counter)
+		claims["events"] = map[string]interface{}{"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{}}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		typ     string
+		claims  jwt.MapClaims
+		wantErr bool
+	}{
+		{"valid token", "logout+jwt", logoutClaims(nil), false},
+		{"valid token with the media type", "application/logout+jwt", logoutClaims(nil), false},
+		{"valid token with only sid", "logout+jwt", logoutClaims(jwt.MapClaims{"sub": nil}), false},
+		{"token typed JWT", "JWT", logoutClaims(nil), true},
+		{"token without typ", "", logoutClaims(nil), true},
+		{"token with a nonce", "logout+jwt", logoutClaims(jwt.MapClaims{"nonce": "nonce"}), true},
+		{"token without events", "logout+jwt", logoutClaims(jwt.MapClaims{"events": nil}), true},
+		{"token with another event", "logout+jwt", logoutClaims(jwt.MapClaims{"events": map[string]interface{}{"other": map[string]interface{}{}}}), true},
+		{"token without sub and sid", "logout+jwt", logoutClaims(jwt.MapClaims{"sub": nil, "sid": nil}), true},
+		{"token without jti", "logout+jwt", logoutClaims(jwt.MapClaims{"jti": nil}), true},
+		{"token for another client", "logout+jwt", logoutClaims(jwt.MapClaims{"aud": "other-client"}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sub, sid string
+			err := authenticator.VerifyLogoutToken(signLogoutToken(t, key, tt.typ, tt.claims), func(s, i string) error {
+				sub, sid = s, i
+				return nil
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("invalid logout token accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("valid logout token rejected: %v", err)
+			}
+			wantSub, _ := tt.claims["sub"].(string)
+			if sub != wantSub || sid != "session-1" {
+				t.Fatalf("got sub %q and sid %q", sub, sid)
+			}
+		})
+	}
+}
+
+func TestVerifyLogoutTokenReplay(t *testing.T) {
+	key := newRSAKey(t, "key-1")
+	authenticator := newTestAuthenticator(t, key)
+
+	claims := idTokenClaims()
+	claims["sid"] = "session-1"
+	claims["jti"] = "replayed-logout"
+	claims["events"] = map[string]interface{}{"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{}}
+	logoutToken := signLogoutToken(t, key, "logout+jwt", claims)
+	logout := func(sub, sid string) error { return nil }
+
+	if err := authenticator.VerifyLogoutToken(logoutToken, logout); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticator.VerifyLogoutToken(logoutToken, logout); err == nil {
+		t.Fatal("replayed logout token accepted")
+	}
+
+	// A new token with the same jti is a replay too
+	claims["iat"] = claims["iat"].(int64) - 1
+	if err := authenticator.VerifyLogoutToken(signLogoutToken(t, key, "logout+jwt", claims), logout); err == nil {
+		t.Fatal("logout token with a used jti accepted")
+	}
+}
+
+func TestVerifyLogoutTokenRetry(t *testing.T) {
+	key := newRSAKey(t, "key-1")
+	authenticator := newTestAuthenticator(t, key)
+
+	claims := idTokenClaims()
+	claims["sid"] = "session-1"
+	claims["jti"] = "retried-logout"
+	claims["events"] = map[string]interface{}{"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{}}
+	logoutToken := signLogoutToken(t, key, "logout+jwt", claims)
+
+	// The ticket registry is down, the provider is told to retry with the same token
+	registryErr := errors.New("ticket registry unavailable")
+	err := authenticator.VerifyLogoutToken(logoutToken, func(sub, sid string) error { return registryErr })
+	if !errors.Is(err, registryErr) {
+		t.Fatalf("got error %v, want the registry error", err)
+	}
+
+	calls := 0
+	logout := func(sub, sid string) error {
+		calls++
+		return nil
+	}
+	if err := authenticator.VerifyLogoutToken(logoutToken, logout); err != nil {
+		t.Fatalf("retried logout token rejected: %v", err)
+	}
+	if err := authenticator.VerifyLogoutToken(logoutToken, logout); err == nil {
+		t.Fatal("logout token accepted again after a successful logout")
+	}
+	if calls != 1 {
+		t.Fatalf("logged out %d times, want once", calls)
+	}
+}
@@ -1,37 +1,184 @@
 package auth
 
 import (
-	"cas-to-oauth2/internal/utils"
+	"cas-to-oauth2/constants"
 	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/oauth2"
 )
 
 type OAuth2Authenticator struct {
-	Config oauth2.Config
+	Config   oauth2.Config
+	Verifier *IDTokenVerifier
+	Metadata *ProviderMetadata
+	UsePKCE  bool
+
+	// ResponseMode is sent as response_mode, form_post makes the provider POST the callback
+	ResponseMode string
+
+	// HTTPClient sends every request to the provider, Breaker is the circuit breaker in its transport
+	HTTPClient *http.Client
+	Breaker    *CircuitBreaker
+
+	// UsePAR pushes the authorization request to PARURL, RequestSigner signs it as a request object for RequestAudience
+	UsePAR          bool
+	PARURL          string
+	RequestSigner   *KeySigner
+	RequestAudience string
+
+	UserInfoURL    string
+	FetchUserInfo  bool
+	PreferUserInfo bool
+
+	EndSessionURL         string
+	UpstreamLogout        bool
+	PostLogoutRedirectURL string
+
+	mutex sync.RWMutex
 }
 
-func NewOAuth2Authenticator(config oauth2.Config) *OAuth2Authenticator {
-	return &OAuth2Authenticator{Config: config}
+func NewOAuth2Authenticator(config oauth2.Config, verifier *IDTokenVerifier) *OAuth2Authenticator {
+	return &OAuth2Authenticator{Config: config, Verifier: verifier}
 }
 
-func (o *OAuth2Authenticator) Authenticate(username, password string) bool {
-	token, err := o.Config.PasswordCredentialsToken(context.Background(), username, password)
-	if err != nil {
+// Authenticate checks the user credentials with the password grant of the provider.
+func (o *OAuth2Authenticator) Authenticate(ctx context.Context, username, password string) (*oauth2.Token, error) {
+	config := o.oauth2Config()
+	return config.PasswordCredentialsToken(o.context(ctx), username, password)
+}
+
+func (o *OAuth2Authenticator) Exchange(c *gin.Context, code string, authRequest *AuthRequest) (*oauth2.Token, error) {
+	var opts []oauth2.AuthCodeOption
+	if o.UsePKCE {
+		opts = append(opts, oauth2.VerifierOption(authRequest.CodeVerifier))
+	}
+
+	config := o.oauth2Config()
+	return config.Exchange(o.context(c), code, opts...)
+}
+
+// Refresh uses the refresh token to check that the user session at the provider is still alive.
+func (o *OAuth2Authenticator) Refresh(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	config := o.oauth2Config()
+	return config.TokenSource(o.context(ctx), &oauth2.Token{RefreshToken: refreshToken}).Token()
+}
+
+// IsRevoked reports whether a token request failed because the provider refused the grant,
+// as opposed to a network or server problem.
+func IsRevoked(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
 		return false
 	}
 
-	return token.Valid()
+	if retrieveErr.ErrorCode != "" {
+		return retrieveErr.ErrorCode == constants.AUTH_ERROR_INVALID_GRANT
+	}
+	return retrieveErr.Response != nil && retrieveErr.Response.StatusCode < http.StatusInternalServerError
 }
 
-func (o *OAuth2Authenticator) Exchange(c *gin.Context, code string) (*oauth2.Token, error) {
-	return o.Config.Exchange(c, code)
+// VerifyToken verifies the ID token included in the token response and returns its claims.
+// The nonce must match the one sent in the authorization request and, when a new
+// authentication was required, the user must have authenticated after the request was made.
+func (o *OAuth2Authenticator) VerifyToken(token *oauth2.Token, authRequest *AuthRequest) (map[string]interface{}, error) {
+	rawIDToken, ok := token.Extra(constants.AUTH_ID_TOKEN).(string)
+	if !ok {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_ID_TOKEN_MISSING)
+	}
+
+	claims, err := o.Verifier.Verify(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenNonce, _ := claims[constants.AUTH_NONCE_PARAM].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(authRequest.Nonce)) != 1 {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_INVALID, constants.AUTH_NONCE_PARAM)
+	}
+
+	if authRequest.Renew {
+		authTime, err := claims.LoadTimeValue(constants.AUTH_AUTH_TIME_CLAIM)
+		if err != nil || authTime == nil || authTime.Before(authRequest.IssuedAt.Add(-o.Verifier.ClockSkew)) {
+			return nil, fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_INVALID, constants.AUTH_AUTH_TIME_CLAIM)
+		}
+	}
+
+	return claims, nil
 }
 
-func (o *OAuth2Authenticator) RedirectAuth(c *gin.Context) {
-	state := utils.RandomString(32)
-	authURL := o.Config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+func (o *OAuth2Authenticator) RedirectAuth(c *gin.Context, authRequest *AuthRequest) {
+	opts := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam(constants.AUTH_NONCE_PARAM, authRequest.Nonce),
+	}
+	if o.UsePKCE {
+		opts = append(opts, oauth2.S256ChallengeOption(authRequest.CodeVerifier))
+	}
+
+	if o.ResponseMode != "" {
+		opts = append(opts, oauth2.SetAuthURLParam(constants.AUTH_RESPONSE_MODE_PARAM, o.ResponseMode))
+	}
+
+	if authRequest.LoginHint != "" {
+		opts = append(opts, oauth2.SetAuthURLParam(constants.AUTH_LOGIN_HINT_PARAM, authRequest.LoginHint))
+	}
+
+	if authRequest.Renew {
+		opts = append(opts,
+			oauth2.SetAuthURLParam(constants.AUTH_PROMPT_PARAM, constants.AUTH_PROMPT_LOGIN),
+			oauth2.SetAuthURLParam(constants.AUTH_MAX_AGE_PARAM, "0"))
+	} else if authRequest.Gateway {
+		opts = append(opts, oauth2.SetAuthURLParam(constants.AUTH_PROMPT_PARAM, constants.AUTH_PROMPT_NONE))
+	}
+
+	config := o.oauth2Config()
+	authURL := config.AuthCodeURL(authRequest.State, opts...)
+
+	if o.UsePAR || o.RequestSigner != nil {
+		var err error
+		if authURL, err = o.protectAuthURL(c, authURL); err != nil {
+			log.Printf("Error protecting the authorization request: %v", err)
+			c.HTML(http.StatusBadGateway, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_UNAVAILABLE})
+			return
+		}
+	}
+
 	c.Redirect(http.StatusFound, authURL)
 }
+
+// UsesFormPost reports whether the provider sends the callback as a form POST.
+func (o *OAuth2Authenticator) UsesFormPost() bool {
+	return o.ResponseMode == constants.AUTH_RESPONSE_MODE_FORM_POST
+}
+
+// Available reports whether the provider can be called, it is not while its circuit breaker is open.
+func (o *OAuth2Authenticator) Available() bool {
+	return o.Breaker == nil || o.Breaker.Available()
+}
+
+// context makes the oauth2 package send the requests of ctx with the client of the authenticator.
+func (o *OAuth2Authenticator) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, o.httpClient())
+}
+
+func (o *OAuth2Authenticator) httpClient() *http.Client {
+	if o.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return o.HTTPClient
+}
+
+// oauth2Config returns a copy of the client configuration, safe to use while discovery updates it.
+func (o *OAuth2Authenticator) oauth2Config() oauth2.Config {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	return o.Config
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// newTestAuthenticator returns an authenticator whose ID tokens are verified with the given keys.
+func newTestAuthenticator(t *testing.T, keys ...testKey) *OAuth2Authenticator {
+	server := newJWKSServer(t, keys...)
+	verifier := NewIDTokenVerifier(testIssuer, testClientID, []string{"RS256", "ES256"}, time.Minute, NewKeySet(server.URL))
+	return NewOAuth2Authenticator(oauth2.Config{ClientID: testClientID}, verifier)
+}
+
+// tokenResponse returns a token response carrying the ID token.
+func tokenResponse(idToken string) *oauth2.Token {
+	token := &oauth2.Token{AccessToken: "access-token", Expiry: time.Now().Add(time.Hour)}
+	return token.WithExtra(map[string]interface{}{"id_token": idToken})
+}
+
+func TestVerifyTokenNonce(t *testing.T) {
+	key := newRSAKey(t, "key-1")
+	authenticator := newTestAuthenticator(t, key)
+	authRequest := NewAuthRequest()
+
+	withNonce := func(nonce interface{}) jwt.MapClaims {
+		claims := idTokenClaims()
+		if nonce != nil {
+			claims["nonce"] = nonce
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		wantErr bool
+	}{
+		{"matching nonce", withNonce(authRequest.Nonce), false},
+		{"nonce of another request", withNonce(NewAuthRequest().Nonce), true},
+		{"empty nonce", withNonce(""), true},
+		{"missing nonce", withNonce(nil), true},
+		{"nonce that is not a string", withNonce(42), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authenticator.VerifyToken(tokenResponse(key.sign(t, tt.claims)), authRequest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenWithoutIDToken(t *testing.T) {
+	authenticator := newTestAuthenticator(t, newRSAKey(t, "key-1"))
+	token := &oauth2.Token{AccessToken: "access-token"}
+
+	if _, err := authenticator.VerifyToken(token, NewAuthRequest()); err == nil {
+		t.Fatal("token response without id_token accepted")
+	}
+}
+
+func TestVerifyTokenAuthTime(t *testing.T) {
+	key := newRSAKey(t, "key-1")
+	authenticator := newTestAuthenticator(t, key)
+
+	renew := NewAuthRequest()
+	renew.Renew = true
+	regular := NewAuthRequest()
+
+	withAuthTime := func(authRequest *AuthRequest, authTime interface{}) jwt.MapClaims {
+		claims := idTokenClaims()
+		claims["nonce"] = authRequest.Nonce
+		if authTime != nil {
+			claims["auth_time"] = authTime
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name        string
+		authRequest *AuthRequest
+		claims      jwt.MapClaims
+		wantErr     bool
+	}{
+		{"renew with a new authentication", renew, withAuthTime(renew, renew.IssuedAt.Add(time.Second).Unix()), false},
+		{"renew with auth_time within the clock skew", renew, withAuthTime(renew, renew.IssuedAt.Add(-30*time.Second).Unix()), false},
+		{"renew without auth_time", renew, withAuthTime(renew, nil), true},
+		{"renew with a stale auth_time", renew, withAuthTime(renew, renew.IssuedAt.Add(-10*time.Minute).Unix()), true},
+		{"renew with an invalid auth_time", renew, withAuthTime(renew, "yesterday"), true},
+		{"no renew without auth_time", regular, withAuthTime(regular, nil), false},
+		{"no renew with a stale auth_time", regular, withAuthTime(regular, regular.IssuedAt.Add(-10*time.Minute).Unix()), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authenticator.VerifyToken(tokenResponse(key.sign(t, tt.claims)), tt.authRequest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedirectAuthPrompt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authenticator := NewOAuth2Authenticator(oauth2.Config{
+		ClientID: testClientID,
+		Endpoint: oauth2.Endpoint{AuthURL: testIssuer + "/authorize"},
+	}, nil)
+
+	tests := []struct {
+		name       string
+		renew      bool
+		gateway    bool
+		wantPrompt string
+		wantMaxAge string
+	}{
+		{"interactive login", false, false, "", ""},
+		{"renew", true, false, "login", "0"},
+		{"gateway", false, true, "none", ""},
+		{"renew wins over gateway", true, true, "login", "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authRequest := NewAuthRequest()
+			authRequest.Renew = tt.renew
+			authRequest.Gateway = tt.gateway
+
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodGet, "/login", nil)
+			authenticator.RedirectAuth(c, authRequest)
+
+			if recorder.Code != http.StatusFound {
+				t.Fatalf("got status %d, want %d", recorder.Code, http.StatusFound)
+			}
+			location, err := url.Parse(recorder.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			query := location.Query()
+			if got := query.Get("prompt"); got != tt.wantPrompt {
+				t.Fatalf("got prompt %q, want %q", got, tt.wantPrompt)
+			}
+			if got := query.Get("max_age"); got != tt.wantMaxAge {
+				t.Fatalf("got max_age %q, want %q", got, tt.wantMaxAge)
+			}
+			if query.Get("state") != authRequest.State || query.Get("nonce") != authRequest.Nonce {
+				t.Fatalf("state or nonce of the request not sent: %v", query)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// protectAuthURL replaces the parameters of the authorization URL with a signed request object (RFC 9101)
+// and/or pushes them to the PAR endpoint (RFC 9126), so the browser only carries a reference to them.
+func (o *OAuth2Authenticator) protectAuthURL(ctx context.Context, authURL string) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+
+	params := u.Query()
+	clientID := params.Get(constants.AUTH_CLIENT_ID_PARAM)
+
+	if o.RequestSigner != nil {
+		requestObject, err := o.requestObject(params)
+		if err != nil {
+			return "", err
+		}
+
+		// response_type and scope are repeated outside the request object for OpenID Connect
+		params = url.Values{
+			constants.AUTH_CLIENT_ID_PARAM:     {clientID},
+			constants.AUTH_RESPONSE_TYPE_PARAM: {params.Get(constants.AUTH_RESPONSE_TYPE_PARAM)},
+			constants.AUTH_SCOPE_PARAM:         {params.Get(constants.AUTH_SCOPE_PARAM)},
+			constants.AUTH_REQUEST_PARAM:       {requestObject},
+		}
+	}
+
+	if o.UsePAR {
+		requestURI, err := o.pushAuthRequest(ctx, params)
+		if err != nil {
+			return "", err
+		}
+
+		params = url.Values{
+			constants.AUTH_CLIENT_ID_PARAM:   {clientID},
+			constants.AUTH_REQUEST_URI_PARAM: {requestURI},
+		}
+	}
+
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// requestObject signs the authorization request parameters as a JWT request object.
+func (o *OAuth2Authenticator) requestObject(params url.Values) (string, error) {
+	claims := signedClaims(params.Get(constants.AUTH_CLIENT_ID_PARAM), o.RequestAudience, AuthRequestLifetime)
+	claims["nbf"] = claims["iat"]
+	for name := range params {
+		claims[name] = params.Get(name)
+	}
+
+	// max_age is a number in the request object
+	if maxAge, err := strconv.Atoi(params.Get(constants.AUTH_MAX_AGE_PARAM)); err == nil {
+		claims[constants.AUTH_MAX_AGE_PARAM] = maxAge
+	}
+
+	return o.RequestSigner.Sign(claims)
+}
+
+// pushAuthRequest sends the authorization request to the PAR endpoint and returns its request_uri.
+// The client authenticates as in the token endpoint.
+func (o *OAuth2Authenticator) pushAuthRequest(ctx context.Context, params url.Values) (string, error) {
+	o.mutex.RLock()
+	parURL := o.PARURL
+	o.mutex.RUnlock()
+
+	if parURL == "" {
+		return "", fmt.Errorf(constants.AUTH_ERRMSG_CONFIG_MISSING, "pushed_authorization_request_endpoint")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, parURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	config := o.oauth2Config()
+	if config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+
+	resp, err := o.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf(constants.AUTH_ERRMSG_PAR_STATUS, resp.StatusCode)
+	}
+
+	var par parResponse
+	if err := json.NewDecoder(resp.Body).Decode(&par); err != nil {
+		return "", err
+	}
+	if par.RequestURI == "" {
+		return "", fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_MISSING, constants.AUTH_REQUEST_URI_PARAM)
+	}
+
+	return par.RequestURI, nil
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// parServer is a fake PAR endpoint that records the pushed requests.
+type parServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	status   int
+	body     string
+	form     url.Values
+	username string
+	password string
+}
+
+func newPARServer(t *testing.T, status int, body string) *parServer {
+	s := &parServer{status: status, body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		s.form = r.PostForm
+		s.username, s.password, _ = r.BasicAuth()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(s.status)
+		_, _ = w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *parServer) pushed() url.Values {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.form
+}
+
+// newPARAuthenticator returns an authenticator with PKCE whose authorization endpoint is on the test issuer.
+func newPARAuthenticator() *OAuth2Authenticator {
+	authenticator := NewOAuth2Authenticator(oauth2.Config{
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "https://cas.example.edu/oauth2/callback",
+		Scopes:       []string{"openid", "email"},
+		Endpoint:     oauth2.Endpoint{AuthURL: testIssuer + "/authorize", TokenURL: testIssuer + "/token"},
+	}, nil)
+	authenticator.UsePKCE = true
+	return authenticator
+}
+
+// newRenewRequest returns an authorization request with every optional parameter set.
+func newRenewRequest() *AuthRequest {
+	authRequest := NewAuthRequest()
+	authRequest.Renew = true
+	authRequest.LoginHint = "jdoe@example.edu"
+	return authRequest
+}
+
+// redirectAuth runs RedirectAuth and returns the response.
+func redirectAuth(t *testing.T, authenticator *OAuth2Authenticator, authRequest *AuthRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, engine := gin.CreateTestContext(recorder)
+	engine.LoadHTMLGlob("../../web/templates/*")
+	c.Request = httptest.NewRequest(http.MethodGet, "/login", nil)
+
+	authenticator.RedirectAuth(c, authRequest)
+	return recorder
+}
+
+func redirectQuery(t *testing.T, recorder *httptest.ResponseRecorder) url.Values {
+	t.Helper()
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusFound)
+	}
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Host != "idp.example.edu" || location.Path != "/authorize" {
+		t.Fatalf("redirected to %s, want the authorization endpoint", location)
+	}
+	return location.Query()
+}
+
+// wantAuthParams returns the parameters of the authorization request built for authRequest.
+func wantAuthParams(authRequest *AuthRequest) map[string]interface{} {
+	return map[string]interface{}{
+		"client_id":             testClientID,
+		"response_type":         "code",
+		"redirect_uri":          "https://cas.example.edu/oauth2/callback",
+		"scope":                 "openid email",
+		"state":                 authRequest.State,
+		"nonce":                 authRequest.Nonce,
+		"code_challenge":        oauth2.S256ChallengeFromVerifier(authRequest.CodeVerifier),
+		"code_challenge_method": "S256",
+		"access_type":           "offline",
+		"login_hint":            authRequest.LoginHint,
+		"prompt":                "login",
+		"max_age":               "0",
+	}
+}
+
+func assertParams(t *testing.T, got url.Values, want map[string]interface{}) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got parameters %v, want %v", got, want)
+	}
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Fatalf("got %s=%q, want %q", name, got.Get(name), value)
+		}
+	}
+}
+
+// assertRequestObject verifies the request object with the key and checks it carries every parameter.
+func assertRequestObject(t *testing.T, requestObject string, key testKey, want map[string]interface{}) {
+	t.Helper()
+	header, claims := parseSigned(t, requestObject, key.key)
+	if header["kid"] != "request-key" {
+		t.Fatalf("got kid %v, want request-key", header["kid"])
+	}
+
+	if claims["iss"] != testClientID || claims["aud"] != testIssuer {
+		t.Fatalf("got iss %v and aud %v, want %s and %s", claims["iss"], claims["aud"], testClientID, testIssuer)
+	}
+	iat, exp := int64(claims["iat"].(float64)), int64(claims["exp"].(float64))
+	if lifetime := time.Duration(exp-iat) * time.Second; lifetime <= 0 || lifetime > AuthRequestLifetime {
+		t.Fatalf("request object is valid for %v", lifetime)
+	}
+	if claims["nbf"] != claims["iat"] || claims["jti"] == "" {
+		t.Fatalf("got nbf %v and jti %v", claims["nbf"], claims["jti"])
+	}
+
+	for name, value := range want {
+		got := claims[name]
+		if name == "max_age" {
+			// max_age is a number in the request object
+			value = float64(0)
+		}
+		if got != value {
+			t.Fatalf("request object has %s=%v, want %v", name, got, value)
+		}
+	}
+}
+
+// newRequestSigner returns a signer of request objects for the test issuer.
+func newRequestSigner(t *testing.T) (*KeySigner, testKey) {
+	key := newECKey(t, "request-key")
+	keyFile := filepath.Join(t.TempDir(), "request.pem")
+	writeKeyFile(t, keyFile, key.key, time.Now())
+	signer, err := NewKeySigner(keyFile, key.kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, key
+}
+
+func TestRedirectAuthWithPAR(t *testing.T) {
+	server := newPARServer(t, http.StatusCreated, `{"request_uri":"urn:ietf:params:oauth:request_uri:abc","expires_in":60}`)
+	authenticator := newPARAuthenticator()
+	authenticator.UsePAR = true
+	authenticator.PARURL = server.URL
+
+	authRequest := newRenewRequest()
+	query := redirectQuery(t, redirectAuth(t, authenticator, authRequest))
+
+	// The browser only carries the client_id and the reference to the pushed request
+	assertParams(t, query, map[string]interface{}{
+		"client_id":   testClientID,
+		"request_uri": "urn:ietf:params:oauth:request_uri:abc",
+	})
+	assertParams(t, server.pushed(), wantAuthParams(authRequest))
+	if server.username != testClientID || server.password != "secret" {
+		t.Fatalf("PAR request authenticated as %q:%q", server.username, server.password)
+	}
+}
+
+func TestRedirectAuthWithRequestObject(t *testing.T) {
+	signer, key := newRequestSigner(t)
+	authenticator := newPARAuthenticator()
+	authenticator.RequestSigner = signer
+	authenticator.RequestAudience = testIssuer
+
+	authRequest := newRenewRequest()
+	query := redirectQuery(t, redirectAuth(t, authenticator, authRequest))
+
+	assertParams(t, query, map[string]interface{}{
+		"client_id":     testClientID,
+		"response_type": "code",
+		"scope":         "openid email",
+		"request":       query.Get("request"),
+	})
+	assertRequestObject(t, query.Get("request"), key, wantAuthParams(authRequest))
+}
+
+func TestRedirectAuthWithPARAndRequestObject(t *testing.T) {
+	server := newPARServer(t, http.StatusCreated, `{"request_uri":"urn:ietf:params:oauth:request_uri:abc","expires_in":60}`)
+	signer, key := newRequestSigner(t)
+	authenticator := newPARAuthenticator()
+	authenticator.UsePAR = true
+	authenticator.PARURL = server.URL
+	authenticator.RequestSigner = signer
+	authenticator.RequestAudience = testIssuer
+
+	authRequest := newRenewRequest()
+	query := redirectQuery(t, redirectAuth(t, authenticator, authRequest))
+
+	assertParams(t, query, map[string]interface{}{
+		"client_id":   testClientID,
+		"request_uri": "urn:ietf:params:oauth:request_uri:abc",
+	})
+
+	pushed := server.pushed()
+	assertParams(t, pushed, map[string]interface{}{
+		"client_id":     testClientID,
+		"response_type": "code",
+		"scope":         "openid email",
+		"request":       pushed.Get("request"),
+	})
+	assertRequestObject(t, pushed.Get("request"), key, wantAuthParams(authRequest))
+}
+
+func TestRedirectAuthPARFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"error status", http.StatusBadRequest, `{"error":"invalid_request"}`},
+		{"response without request_uri", http.StatusCreated, `{"expires_in":60}`},
+		{"invalid response", http.StatusCreated, `not json`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newPARServer(t, tt.status, tt.body)
+			authenticator := newPARAuthenticator()
+			authenticator.UsePAR = true
+			authenticator.PARURL = server.URL
+
+			recorder := redirectAuth(t, authenticator, NewAuthRequest())
+			if recorder.Code != http.StatusBadGateway || recorder.Header().Get("Location") != "" {
+				t.Fatalf("got status %d and Location %q, want an error page", recorder.Code, recorder.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestPushAuthRequestWithoutEndpoint(t *testing.T) {
+	authenticator := newPARAuthenticator()
+	if _, err := authenticator.pushAuthRequest(context.Background(), url.Values{}); err == nil {
+		t.Fatal("authorization request pushed without a PAR endpoint")
+	}
+}
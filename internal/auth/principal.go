@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PrincipalResolver chooses the username released to CAS services from the user attributes.
+// The first claim in Claims that has a value is used, then every transformation is applied in order.
+type PrincipalResolver struct {
+	Claims     []string
+	Transforms []func(string) string
+}
+
+// NewPrincipalResolver builds a resolver from the configured claim names and transformation names.
+// Supported transformations are lowercase, uppercase, trim, strip_domain and regex, which
+// replaces the matches of pattern with replacement.
+func NewPrincipalResolver(claims, transforms []string, pattern, replacement string) (*PrincipalResolver, error) {
+	resolver := &PrincipalResolver{Claims: claims}
+
+	for _, name := range transforms {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "lowercase":
+			resolver.Transforms = append(resolver.Transforms, strings.ToLower)
+		case "uppercase":
+			resolver.Transforms = append(resolver.Transforms, strings.ToUpper)
+		case "trim":
+			resolver.Transforms = append(resolver.Transforms, strings.TrimSpace)
+		case "strip_domain":
+			resolver.Transforms = append(resolver.Transforms, stripDomain)
+		case "regex":
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			resolver.Transforms = append(resolver.Transforms, func(value string) string {
+				return re.ReplaceAllString(value, replacement)
+			})
+		default:
+			return nil, fmt.Errorf(constants.AUTH_ERRMSG_PRINCIPAL_TRANSFORM, name)
+		}
+	}
+
+	return resolver, nil
+}
+
+// Resolve returns the principal for the given user attributes.
+func (p *PrincipalResolver) Resolve(attributes map[string][]string) (string, error) {
+	for _, claim := range p.Claims {
+		values := attributes[strings.TrimSpace(claim)]
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+
+		principal := values[0]
+		for _, transform := range p.Transforms {
+			principal = transform(principal)
+		}
+
+		if principal != "" {
+			return principal, nil
+		}
+	}
+
+	return "", fmt.Errorf(constants.AUTH_ERRMSG_PRINCIPAL, p.Claims)
+}
+
+func stripDomain(value string) string {
+	if at := strings.LastIndex(value, "@"); at >= 0 {
+		return value[:at]
+	}
+	return value
+}
@@ -0,0 +1,78 @@
+package auth
+
+import "testing"
+
+func TestPrincipalResolver(t *testing.T) {
+	attributes := map[string][]string{
+		"preferred_username": {""},
+		"email":              {" John.Doe@Example.edu ", "jdoe@example.edu"},
+		"upn":                {"jdoe@ad.example.edu"},
+		"sub":                {"248289761001"},
+	}
+
+	tests := []struct {
+		name        string
+		claims      []string
+		transforms  []string
+		pattern     string
+		replacement string
+		want        string
+		wantErr     bool
+	}{
+		{"first claim with a value", []string{"upn", "email"}, nil, "", "", "jdoe@ad.example.edu", false},
+		{"empty claim falls back", []string{"preferred_username", "upn"}, nil, "", "", "jdoe@ad.example.edu", false},
+		{"missing claim falls back", []string{"username", "sub"}, nil, "", "", "248289761001", false},
+		{"claim names are trimmed", []string{" sub "}, nil, "", "", "248289761001", false},
+		{"first value of a claim", []string{"email"}, []string{"trim"}, "", "", "John.Doe@Example.edu", false},
+		{"transforms in order", []string{"email"}, []string{"trim", "lowercase", "strip_domain"}, "", "", "john.doe", false},
+		{"uppercase", []string{"upn"}, []string{"uppercase"}, "", "", "JDOE@AD.EXAMPLE.EDU", false},
+		{"strip_domain without domain", []string{"sub"}, []string{"strip_domain"}, "", "", "248289761001", false},
+		{"strip_domain keeps the local part", []string{"upn"}, []string{"strip_domain"}, "", "", "jdoe", false},
+		{"regex replacement", []string{"upn"}, []string{"regex"}, `^(\w+)@ad\.(.+)$`, "$1@$2", "jdoe@example.edu", false},
+		{"regex without match", []string{"sub"}, []string{"regex"}, `@.*$`, "", "248289761001", false},
+		{"transform to empty falls back", []string{"upn", "sub"}, []string{"regex"}, `.*@ad\..*`, "", "248289761001", false},
+		{"only empty claims", []string{"preferred_username", "username"}, nil, "", "", "", true},
+		{"no claims", nil, nil, "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewPrincipalResolver(tt.claims, tt.transforms, tt.pattern, tt.replacement)
+			if err != nil {
+				t.Fatalf("NewPrincipalResolver() error = %v", err)
+			}
+
+			got, err := resolver.Resolve(attributes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPrincipalResolverErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms []string
+		pattern    string
+	}{
+		{"invalid regex", []string{"regex"}, `(unclosed`},
+		{"unknown transform", []string{"lowercase", "reverse"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPrincipalResolver([]string{"email"}, tt.transforms, tt.pattern, ""); err == nil {
+				t.Fatal("NewPrincipalResolver() error = nil, want an error")
+			}
+		})
+	}
+
+	// Blank transform names, as left by a trailing comma in the configuration, are ignored
+	if _, err := NewPrincipalResolver([]string{"email"}, []string{"lowercase", " "}, "", ""); err != nil {
+		t.Fatalf("NewPrincipalResolver() error = %v", err)
+	}
+}
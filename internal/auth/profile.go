@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// ProfileAuthenticator authenticates with plain OAuth2 providers that return no ID token,
+// such as GitHub. The user is read from a profile API called with the access token: the
+// subject from the SubjectPath field and the attributes from the Attributes fields, or
+// every field of the profile when Attributes is empty.
+type ProfileAuthenticator struct {
+	*OAuth2Authenticator
+
+	ProfileURL  string
+	SubjectPath string
+	Attributes  map[string]string
+}
+
+func NewProfileAuthenticator(config oauth2.Config, profileURL, subjectPath string, attributes map[string]string) *ProfileAuthenticator {
+	return &ProfileAuthenticator{
+		OAuth2Authenticator: NewOAuth2Authenticator(config, nil),
+		ProfileURL:          profileURL,
+		SubjectPath:         subjectPath,
+		Attributes:          attributes,
+	}
+}
+
+// VerifyToken returns no claims, there is no ID token to verify. The access token is
+// checked by the profile API in UserInfo.
+func (p *ProfileAuthenticator) VerifyToken(token *oauth2.Token, authRequest *AuthRequest) (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+// UserInfo fetches the profile of the user and returns its fields as claims, with the subject in sub.
+func (p *ProfileAuthenticator) UserInfo(ctx context.Context, token *oauth2.Token, claims map[string]interface{}) (map[string]interface{}, error) {
+	config := p.oauth2Config()
+	resp, err := config.Client(p.context(ctx), token).Get(p.ProfileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_PROFILE_STATUS, resp.StatusCode)
+	}
+
+	var profile interface{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&profile); err != nil {
+		return nil, err
+	}
+
+	value, _ := LookupPath(profile, p.SubjectPath)
+	subject := subjectString(value)
+	if subject == "" {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_MISSING, p.SubjectPath)
+	}
+
+	profileClaims := map[string]interface{}{}
+	if len(p.Attributes) == 0 {
+		if fields, ok := profile.(map[string]interface{}); ok {
+			for name, value := range fields {
+				profileClaims[name] = value
+			}
+		}
+	}
+	for name, path := range p.Attributes {
+		if value, ok := LookupPath(profile, path); ok && value != nil {
+			profileClaims[name] = value
+		}
+	}
+
+	profileClaims[constants.AUTH_SUBJECT_CLAIM] = subject
+	return profileClaims, nil
+}
+
+// subjectString returns the subject as a string, with numeric IDs written as in the profile.
+// Other values can not identify the user and give an empty string.
+func subjectString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// LogoutURL returns an empty string, plain OAuth2 has no end_session_endpoint.
+func (p *ProfileAuthenticator) LogoutURL(idToken, postLogoutRedirectURI string) string {
+	return ""
+}
+
+// VerifyLogoutToken always fails, plain OAuth2 providers do not send back-channel logout requests.
+func (p *ProfileAuthenticator) VerifyLogoutToken(rawLogoutToken string, logout func(sub, sid string) error) error {
+	return fmt.Errorf(constants.AUTH_ERRMSG_LOGOUT_UNSUPPORTED)
+}
+
+// LookupPath returns the field of a JSON document selected by a dot separated path, such as
+// user.login or emails.0.address. Numeric segments index arrays. A leading $ is ignored.
+func LookupPath(document interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return document, true
+	}
+
+	value := document
+	for _, segment := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			value = node[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
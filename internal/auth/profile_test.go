@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"cas-to-oauth2/internal/utils"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const testProfile = `{
+	"id": 1234500,
+	"login": "jdoe",
+	"user": {"login": "jdoe", "name": null},
+	"emails": [{"email": "jdoe@example.edu"}, {"email": "john.doe@example.edu"}],
+	"tags": ["staff", "teachers"]
+}`
+
+func TestLookupPath(t *testing.T) {
+	var profile interface{}
+	if err := json.Unmarshal([]byte(testProfile), &profile); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		want   interface{}
+		wantOK bool
+	}{
+		{"top level field", "login", "jdoe", true},
+		{"nested field", "user.login", "jdoe", true},
+		{"null field", "user.name", nil, true},
+		{"array index", "emails.0.email", "jdoe@example.edu", true},
+		{"second array index", "emails.1.email", "john.doe@example.edu", true},
+		{"array of strings", "tags.1", "teachers", true},
+		{"out of range index", "emails.5.email", nil, false},
+		{"negative index", "emails.-1.email", nil, false},
+		{"index that is not a number", "emails.first.email", nil, false},
+		{"missing field", "user.email", nil, false},
+		{"field of a string", "login.name", nil, false},
+		{"leading $", "$.user.login", "jdoe", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := LookupPath(profile, tt.path)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("LookupPath(%q) = %v, %v, want %v, %v", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	if got, ok := LookupPath(profile, ""); !ok || !reflect.DeepEqual(got, profile) {
+		t.Fatalf("LookupPath(\"\") = %v, %v, want the whole document", got, ok)
+	}
+}
+
+// newProfileServer returns a profile API that answers the access-token bearer with the body.
+func newProfileServer(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func profileUserInfo(t *testing.T, status int, body, subjectPath string, attributes map[string]string) (map[string]interface{}, error) {
+	server := newProfileServer(t, status, body)
+	authenticator := NewProfileAuthenticator(oauth2.Config{ClientID: testClientID}, server.URL, subjectPath, attributes)
+	token := &oauth2.Token{AccessToken: "access-token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+	return authenticator.UserInfo(context.Background(), token, map[string]interface{}{})
+}
+
+func TestProfileUserInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		subjectPath string
+		attributes  map[string]string
+		want        map[string][]string
+		wantSubject string
+	}{
+		{
+			name:        "numeric id",
+			body:        testProfile,
+			subjectPath: "id",
+			attributes:  map[string]string{"id": "id", "email": "emails.0.email"},
+			want:        map[string][]string{"sub": {"1234500"}, "id": {"1234500"}, "email": {"jdoe@example.edu"}},
+			wantSubject: "1234500",
+		},
+		{
+			name:        "id larger than a float64 holds exactly",
+			body:        `{"id": 12345678901234567890}`,
+			subjectPath: "id",
+			want:        map[string][]string{"sub": {"12345678901234567890"}, "id": {"12345678901234567890"}},
+			wantSubject: "12345678901234567890",
+		},
+		{
+			name:        "nested subject",
+			body:        testProfile,
+			subjectPath: "user.login",
+			attributes:  map[string]string{"tags": "tags", "missing": "emails.5.email", "name": "user.name"},
+			want:        map[string][]string{"sub": {"jdoe"}, "tags": {"staff", "teachers"}},
+			wantSubject: "jdoe",
+		},
+		{
+			name:        "every field without attributes",
+			body:        `{"login": "jdoe", "admin": false, "score": 1.5}`,
+			subjectPath: "login",
+			want:        map[string][]string{"sub": {"jdoe"}, "login": {"jdoe"}, "admin": {"false"}, "score": {"1.5"}},
+			wantSubject: "jdoe",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := profileUserInfo(t, http.StatusOK, tt.body, tt.subjectPath, tt.attributes)
+			if err != nil {
+				t.Fatalf("UserInfo() error = %v", err)
+			}
+
+			if subject, _ := claims["sub"].(string); subject != tt.wantSubject {
+				t.Fatalf("sub = %#v, want %q", claims["sub"], tt.wantSubject)
+			}
+			if got := utils.GetAttributesFromClaims(claims); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("attributes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileUserInfoErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		subjectPath string
+	}{
+		{"missing subject", http.StatusOK, testProfile, "uid"},
+		{"subject out of range", http.StatusOK, testProfile, "emails.5.email"},
+		{"null subject", http.StatusOK, testProfile, "user.name"},
+		{"empty subject", http.StatusOK, `{"login": ""}`, "login"},
+		{"subject that is an object", http.StatusOK, testProfile, "user"},
+		{"error status", http.StatusUnauthorized, `{"message": "Bad credentials"}`, "login"},
+		{"invalid JSON", http.StatusOK, `{"login":`, "login"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if claims, err := profileUserInfo(t, tt.status, tt.body, tt.subjectPath, nil); err == nil {
+				t.Fatalf("UserInfo() = %v, want an error", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers single-use values until they expire, so they are accepted only once.
+// It lives in the memory of the process; the values it holds are short-lived anyway.
+type ReplayCache struct {
+	mutex    sync.Mutex
+	seen     map[string]time.Time
+	prunedAt time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time)}
+}
+
+// Use records the value until expires and reports whether it had not been used before.
+func (r *ReplayCache) Use(value string, expires time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.prunedAt) >= time.Minute {
+		for seenValue, seenExpires := range r.seen {
+			if now.After(seenExpires) {
+				delete(r.seen, seenValue)
+			}
+		}
+		r.prunedAt = now
+	}
+
+	if seenExpires, ok := r.seen[value]; ok && !now.After(seenExpires) {
+		return false
+	}
+	r.seen[value] = expires
+	return true
+}
+
+// Release forgets a used value, so it is accepted again.
+func (r *ReplayCache) Release(value string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.seen, value)
+}
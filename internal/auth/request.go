@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"cas-to-oauth2/internal/utils"
+	"crypto/subtle"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// AuthRequestLifetime is how long the user has to complete the login at the OAuth2 provider.
+var AuthRequestLifetime = 10 * time.Minute
+
+// AuthRequest binds an authorization request sent to the OAuth2 provider to the browser
+// that started it. It travels in a signed and encrypted cookie and is consumed by the callback.
+// Renew and Gateway carry the CAS parameters of the same name, so the provider can be asked
+// to force a new authentication or to not interact with the user at all.
+// Provider is the name of the provider the request was sent to, only its callback accepts it.
+// LoginHint is the email or username typed by the user, forwarded so the provider can prefill it.
+type AuthRequest struct {
+	Provider     string
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Renew        bool
+	Gateway      bool
+	LoginHint    string
+	IssuedAt     time.Time
+	Expires      time.Time
+}
+
+func NewAuthRequest() *AuthRequest {
+	now := time.Now()
+	return &AuthRequest{
+		State:        utils.RandomString(32),
+		Nonce:        utils.RandomString(32),
+		CodeVerifier: oauth2.GenerateVerifier(),
+		IssuedAt:     now,
+		Expires:      now.Add(AuthRequestLifetime),
+	}
+}
+
+// Matches reports whether the request is still alive and was issued with the given state.
+func (a *AuthRequest) Matches(state string) bool {
+	if a == nil || a.State == "" || time.Now().After(a.Expires) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(a.State), []byte(state)) == 1
+}
+
+// consumedStates holds the states of the requests already consumed, until they expire.
+var consumedStates = NewReplayCache()
+
+// Consume checks the request like Matches and marks its state as used, so a copy of
+// the cookie is rejected even when the browser did not remove it.
+func (a *AuthRequest) Consume(state string) bool {
+	return a.Matches(state) && consumedStates.Use(a.State, a.Expires)
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthRequestMatches(t *testing.T) {
+	expired := NewAuthRequest()
+	expired.Expires = time.Now().Add(-time.Second)
+	valid := NewAuthRequest()
+
+	tests := []struct {
+		name    string
+		request *AuthRequest
+		state   string
+		want    bool
+	}{
+		{"matching state", valid, valid.State, true},
+		{"state mismatch", valid, "another-state", false},
+		{"empty state", valid, "", false},
+		{"request without state", &AuthRequest{Expires: time.Now().Add(time.Minute)}, "", false},
+		{"expired request", expired, expired.State, false},
+		{"no request", nil, "state", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.request.Matches(tt.state); got != tt.want {
+				t.Fatalf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthRequestConsume(t *testing.T) {
+	request := NewAuthRequest()
+	if request.Consume("another-state") {
+		t.Fatal("request consumed with a mismatched state")
+	}
+	if !request.Consume(request.State) {
+		t.Fatal("request not consumed with its state")
+	}
+
+	replayed := *request
+	if replayed.Consume(request.State) {
+		t.Fatal("replayed request consumed twice")
+	}
+}
+
+func TestReplayCacheForgetsExpiredValues(t *testing.T) {
+	cache := NewReplayCache()
+	if !cache.Use("value", time.Now().Add(-time.Second)) {
+		t.Fatal("new value rejected")
+	}
+	if !cache.Use("value", time.Now().Add(time.Minute)) {
+		t.Fatal("value rejected after it expired")
+	}
+	if cache.Use("value", time.Now().Add(time.Minute)) {
+		t.Fatal("value accepted twice")
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// UserInfo completes the ID token claims with the claims returned by the UserInfo endpoint.
+// When FetchUserInfo is disabled the claims are returned unchanged. On conflicting claims the
+// ID token wins, unless PreferUserInfo is set.
+func (o *OAuth2Authenticator) UserInfo(ctx context.Context, token *oauth2.Token, claims map[string]interface{}) (map[string]interface{}, error) {
+	if !o.FetchUserInfo {
+		return claims, nil
+	}
+
+	o.mutex.RLock()
+	userInfoURL := o.UserInfoURL
+	o.mutex.RUnlock()
+
+	if userInfoURL == "" {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_CONFIG_MISSING, "userinfo_endpoint")
+	}
+
+	config := o.oauth2Config()
+	resp, err := config.Client(o.context(ctx), token).Get(userInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_USERINFO_STATUS, resp.StatusCode)
+	}
+
+	var userInfo map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, err
+	}
+
+	// The UserInfo response must belong to the user of the ID token
+	if userInfo[constants.AUTH_SUBJECT_CLAIM] != claims[constants.AUTH_SUBJECT_CLAIM] {
+		return nil, fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_INVALID, constants.AUTH_SUBJECT_CLAIM)
+	}
+
+	merged := make(map[string]interface{}, len(claims)+len(userInfo))
+	for name, value := range userInfo {
+		merged[name] = value
+	}
+	for name, value := range claims {
+		if _, exists := merged[name]; exists && o.PreferUserInfo {
+			continue
+		}
+		merged[name] = value
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"cas-to-oauth2/constants"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+)
+
+// IDTokenVerifier checks the signature and the standard claims of the ID tokens
+// issued by the OAuth2 provider.
+type IDTokenVerifier struct {
+	Issuer     string
+	ClientID   string
+	Algorithms []string
+	ClockSkew  time.Duration
+	Keys       *KeySet
+}
+
+func NewIDTokenVerifier(issuer, clientID string, algorithms []string, clockSkew time.Duration, keys *KeySet) *IDTokenVerifier {
+	return &IDTokenVerifier{
+		Issuer:     issuer,
+		ClientID:   clientID,
+		Algorithms: algorithms,
+		ClockSkew:  clockSkew,
+		Keys:       keys,
+	}
+}
+
+// Verify parses the raw ID token and returns its claims only if the signature
+// and the iss, aud, exp, iat and nbf claims are valid.
+func (v *IDTokenVerifier) Verify(rawIDToken string) (jwt.MapClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(v.Algorithms),
+		jwt.WithLeeway(v.ClockSkew),
+		jwt.WithAudience(v.ClientID),
+		jwt.WithIssuer(v.Issuer),
+	)
+
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(rawIDToken, claims, v.Keys.Keyfunc); err != nil {
+		return nil, err
+	}
+
+	if err := v.verifyRequiredClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *IDTokenVerifier) verifyRequiredClaims(claims jwt.MapClaims) error {
+	aud, err := jwt.ParseClaimStrings(claims["aud"])
+	if err != nil || len(aud) == 0 {
+		return fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_MISSING, "aud")
+	}
+
+	// With several audiences the token must have been issued to this client
+	if len(aud) > 1 && claims["azp"] != v.ClientID {
+		return fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_INVALID, "azp")
+	}
+
+	exp, err := claims.LoadTimeValue("exp")
+	if err != nil || exp == nil {
+		return fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_MISSING, "exp")
+	}
+
+	iat, err := claims.LoadTimeValue("iat")
+	if err != nil || iat == nil {
+		return fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_MISSING, "iat")
+	}
+
+	if iat.Time.After(time.Now().Add(v.ClockSkew)) {
+		return fmt.Errorf(constants.AUTH_ERRMSG_CLAIM_INVALID, "iat")
+	}
+
+	return nil
+}
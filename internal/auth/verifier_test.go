@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+)
+
+func TestIDTokenVerifier(t *testing.T) {
+	rsaKey := newRSAKey(t, "rsa-1")
+	ecKey := newECKey(t, "ec-1")
+	unpublished := newRSAKey(t, "rsa-1")
+	server := newJWKSServer(t, rsaKey, ecKey)
+	verifier := NewIDTokenVerifier(testIssuer, testClientID, []string{"RS256", "ES256"}, time.Minute, NewKeySet(server.URL))
+
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := idTokenClaims()
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	now := time.Now()
+
+	noneToken := jwt.NewWithClaims(jwt.SigningMethodNone, idTokenClaims())
+	none, err := noneToken.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid RSA", rsaKey.sign(t, idTokenClaims()), false},
+		{"valid EC", ecKey.sign(t, idTokenClaims()), false},
+		{"several audiences with azp", rsaKey.sign(t, with(jwt.MapClaims{"aud": []string{testClientID, "other"}, "azp": testClientID})), false},
+		{"expired within clock skew", rsaKey.sign(t, with(jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()})), false},
+		{"alg none", none, true},
+		{"alg not allowed", signHS256(t, idTokenClaims()), true},
+		{"alg of another key", ecKeyAsRSAKid(t, ecKey, idTokenClaims()), true},
+		{"signed with another key", unpublished.sign(t, idTokenClaims()), true},
+		{"wrong issuer", rsaKey.sign(t, with(jwt.MapClaims{"iss": "https://evil.example.com"})), true},
+		{"wrong audience", rsaKey.sign(t, with(jwt.MapClaims{"aud": "other-client"})), true},
+		{"missing audience", rsaKey.sign(t, with(jwt.MapClaims{"aud": nil})), true},
+		{"several audiences without azp", rsaKey.sign(t, with(jwt.MapClaims{"aud": []string{testClientID, "other"}})), true},
+		{"several audiences with another azp", rsaKey.sign(t, with(jwt.MapClaims{"aud": []string{testClientID, "other"}, "azp": "other"})), true},
+		{"expired", rsaKey.sign(t, with(jwt.MapClaims{"exp": now.Add(-5 * time.Minute).Unix()})), true},
+		{"missing exp", rsaKey.sign(t, with(jwt.MapClaims{"exp": nil})), true},
+		{"missing iat", rsaKey.sign(t, with(jwt.MapClaims{"iat": nil})), true},
+		{"iat in the future", rsaKey.sign(t, with(jwt.MapClaims{"iat": now.Add(5 * time.Minute).Unix()})), true},
+		{"nbf in the future", rsaKey.sign(t, with(jwt.MapClaims{"nbf": now.Add(5 * time.Minute).Unix()})), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("token accepted with claims %v", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("valid token rejected: %v", err)
+			}
+			if claims["sub"] != "jdoe" {
+				t.Fatalf("got sub %v, want jdoe", claims["sub"])
+			}
+		})
+	}
+}
+
+// signHS256 signs the claims with a shared secret, which the verifier must never accept.
+func signHS256(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "rsa-1"
+	signed, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// ecKeyAsRSAKid signs with the EC key but names the RSA key, whose alg is RS256.
+func ecKeyAsRSAKid(t *testing.T, key testKey, claims jwt.MapClaims) string {
+	key.kid = "rsa-1"
+	return key.sign(t, claims)
+}
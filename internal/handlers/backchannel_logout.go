@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/internal/utils"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackchannelLogout receives the OpenID Connect Back-Channel Logout requests sent by the OAuth2 provider
+// when a user logs out there or the account is disabled. Every TGT of that user session is deleted.
+// Every provider has its own path, the plain one belongs to the first provider.
+// Parameters from body (form encoded):
+//   - logout_token: A JWT signed by the OAuth2 provider identifying the subject and/or session to log out.
+//
+// Returns:
+//   - 200 when the TGTs were deleted, 400 when the logout token is invalid, 404 for an unknown provider,
+//     or 500 when the TGTs could not be deleted.
+func BackchannelLogout(c *gin.Context) {
+	span, _ := utils.StartAPMSpan(c.Request.Context(), config.AppConfig.UseAPM, utils.GetFunctionName(), "")
+	defer utils.EndAPMSpan(span)
+
+	c.Header("Cache-Control", "no-store")
+
+	provider := callbackProvider(c)
+	if provider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": constants.LOGOUT_INVALID_REQUEST, "error_description": constants.LOGIN_ERRMSG_PROVIDER})
+		return
+	}
+
+	var deleted int64
+	var deleteErr error
+	err := provider.Authenticator.VerifyLogoutToken(c.PostForm(constants.AUTH_LOGOUT_TOKEN_PARAM), func(sub, sid string) error {
+		deleted, deleteErr = utils.DeleteTGTsBySession(provider.Name, sub, sid)
+		return deleteErr
+	})
+	if deleteErr != nil {
+		log.Printf("%s: %v", constants.LOGOUT_ERRMSG_BACKCHANNEL, deleteErr)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("Invalid back-channel logout token: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": constants.LOGOUT_INVALID_REQUEST, "error_description": err.Error()})
+		return
+	}
+
+	utils.SetAPMLabel(span, "deletedTGTs", deleted)
+	c.Status(http.StatusOK)
+}
@@ -4,6 +4,7 @@ import (
 	"cas-to-oauth2/config"
 	"cas-to-oauth2/constants"
 	"cas-to-oauth2/internal/utils"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -11,7 +12,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func redirectToService(c *gin.Context, serviceURL, username, tgt string, isDirect bool) {
+func redirectToService(c *gin.Context, serviceURL, username string, attributes map[string][]string, tgt string, isDirect bool) {
 	if serviceURL == "" {
 		c.HTML(http.StatusOK, constants.LOGIN_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_OK})
 		return
@@ -32,7 +33,12 @@ func redirectToService(c *gin.Context, serviceURL, username, tgt string, isDirec
 		}
 	}
 
-	serviceTicket := utils.GenerateServiceTicket(serviceURL, username, tgt, isDirect)
+	serviceTicket, err := utils.GenerateServiceTicket(serviceURL, username, attributes, tgt, isDirect)
+	if err != nil {
+		log.Printf("Error storing service ticket: %v", err)
+		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.COMMON_ERRMSG_REGISTRY})
+		return
+	}
 
 	parsedServiceURL, err := url.Parse(serviceURL)
 	if err != nil {
@@ -48,13 +54,17 @@ func redirectToService(c *gin.Context, serviceURL, username, tgt string, isDirec
 }
 
 func checkAllowedDomains(serviceURL string) bool {
+	return matchesDomain(serviceURL, config.AppConfig.AllowedDomains)
+}
+
+func matchesDomain(serviceURL string, domains []string) bool {
 	u, err := url.Parse(serviceURL)
 	if err != nil {
 		return false
 	}
 
 	host := u.Hostname()
-	for _, domain := range config.AppConfig.AllowedDomains {
+	for _, domain := range domains {
 		if strings.HasSuffix(host, domain) {
 			return true
 		}
@@ -67,10 +77,31 @@ func setCookie(c *gin.Context, tgtName, tgtValue, domain string, duration int) {
 	c.SetCookie(tgtName, tgtValue, duration, "/", domain, config.AppConfig.TGTSecure, config.AppConfig.TGTHttpOnly)
 }
 
+// setCrossSiteCookie sets a cookie that the browser also sends in the form POST of the provider to the callback.
+// SameSite=None is only accepted by browsers on secure cookies.
+func setCrossSiteCookie(c *gin.Context, name, value, domain string, duration int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		MaxAge:   duration,
+		Path:     "/",
+		Domain:   domain,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
 func unsetCookie(c *gin.Context, tgtName, domain string) {
 	c.SetCookie(tgtName, "", -1, "/", domain, config.AppConfig.TGTSecure, config.AppConfig.TGTHttpOnly)
 }
 
+// showMaintenance tells the user the provider is down, while its circuit breaker is open.
+func showMaintenance(c *gin.Context) {
+	c.Header("Retry-After", "60")
+	c.HTML(http.StatusServiceUnavailable, constants.MAINTENANCE_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.LOGIN_ERRMSG_MAINTENANCE})
+}
+
 func Head(c *gin.Context) {
 	c.Status(http.StatusOK)
 	return
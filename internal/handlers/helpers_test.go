@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/database"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+)
+
+// setupConfig installs a test configuration with the given providers, restored when the test ends.
+func setupConfig(t *testing.T, providers ...*config.Provider) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	appConfig, allProviders := config.AppConfig, config.Providers
+	t.Cleanup(func() {
+		config.AppConfig, config.Providers = appConfig, allProviders
+	})
+
+	config.AppConfig = config.Config{
+		SecureCookie:   securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
+		TokenCipher:    securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)).MaxAge(0),
+		TGTName:        "CASTGC",
+		TGTDuration:    3600,
+		Domain:         "cas.example.edu",
+		AllowedDomains: []string{"service.example.edu"},
+	}
+	config.Providers = providers
+}
+
+// setupRegistry stores the tickets of the test in memory.
+func setupRegistry(t *testing.T) {
+	t.Helper()
+	registry, err := database.NewMemoryRegistry("", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := database.Registry
+	database.Registry = registry
+	t.Cleanup(func() {
+		_ = registry.Close(context.Background())
+		database.Registry = previous
+	})
+}
+
+// newContext returns a gin context for the request, with the HTML templates loaded.
+func newContext(req *http.Request) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, engine := gin.CreateTestContext(recorder)
+	engine.LoadHTMLGlob("../../web/templates/*")
+	c.Request = req
+	return c, recorder
+}
+
+// responseCookie returns the cookie of the given name set by the response, or nil.
+// When the response sets it several times the last one is returned, as the browser keeps it.
+func responseCookie(recorder *httptest.ResponseRecorder, name string) *http.Cookie {
+	var result *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == name {
+			result = cookie
+		}
+	}
+	return result
+}
@@ -3,22 +3,38 @@ package handlers
 import (
 	"cas-to-oauth2/config"
 	"cas-to-oauth2/constants"
+	"cas-to-oauth2/database"
+	"cas-to-oauth2/internal/auth"
 	"cas-to-oauth2/internal/utils"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // Login handles the user authentication process using the CAS protocol and redirecting to an OAuth2 server.
+// When several providers are configured and neither the request nor the service selects one,
+// the provider is discovered from the domain of the login hint with the home realm rules or,
+// failing that, the user chooses it in a list of providers.
+// When the login form is enabled for the deployment or the service, the credentials are asked in
+// our own form instead and checked with the OAuth2 provider when the form is posted back.
 // The function processes the following OPTIONAL query parameters from the request:
 //   - service: URL of the service where the user intends to be redirected after authentication.
 //   - renew: Indicates if the client wants to force re-authentication, regardless of existing session.
 //   - gateway: If true, the client will not be prompted for credentials if not already logged in.
+//   - provider: Name of the provider to log in with.
+//   - login_hint: Email or username of the user, forwarded to the provider.
 //
 // Returns:
 //   - Depending on the outcome of the authentication process and provided parameters,
 //     the function may redirect the user, send specific error messages, or render certain views.
 func Login(c *gin.Context) {
+	if c.Request.Method == http.MethodPost {
+		credentialLogin(c)
+		return
+	}
+
 	span, _ := utils.StartAPMSpan(c.Request.Context(), config.AppConfig.UseAPM, utils.GetFunctionName(), "")
 	defer utils.EndAPMSpan(span)
 
@@ -30,39 +46,154 @@ func Login(c *gin.Context) {
 	utils.SetAPMLabel(span, constants.COMMON_RENEW_PARAM, renew)
 	utils.SetAPMLabel(span, constants.COMMON_GATEWAY_PARAM, gateway)
 
-	isLoggedIn, username := isLoggedIn(c, config.AppConfig.TGTName)
+	provider, ok := selectProvider(c.Query(constants.LOGIN_PROVIDER_PARAM), serviceURL)
+	if !ok {
+		c.HTML(http.StatusBadRequest, constants.UNAUTHORIZED_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.LOGIN_ERRMSG_PROVIDER})
+		return
+	}
+
+	loginHint := c.Query(constants.AUTH_LOGIN_HINT_PARAM)
+	if provider == nil && loginHint != "" {
+		provider = discoverProvider(loginHint)
+	}
+
+	isLoggedIn, session, err := isLoggedIn(c, config.AppConfig.TGTName)
+	if err != nil {
+		log.Printf("Error validating TGT: %v", err)
+		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.COMMON_ERRMSG_REGISTRY})
+		return
+	}
 	utils.SetAPMLabel(span, "isLoggedIn", isLoggedIn)
 
-	if utils.IsTrue(gateway) && !utils.IsTrue(renew) {
-		if isLoggedIn {
-			redirectToService(c, serviceURL, username, "", false)
-			return
-		} else {
+	// A session is only reused when it comes from the provider selected for this login, if any
+	if isLoggedIn && !utils.IsTrue(renew) && (provider == nil || provider == sessionProvider(session)) && refreshSession(c, session) {
+		redirectToService(c, serviceURL, session.Username, session.Attributes, "", false)
+		return
+	}
+
+	// Neither the provider chooser nor our own form can authenticate without prompting the user
+	passive := utils.IsTrue(gateway) && !utils.IsTrue(renew)
+
+	if provider == nil {
+		if passive {
 			c.Redirect(http.StatusSeeOther, serviceURL)
 			return
 		}
+
+		message := ""
+		if loginHint != "" {
+			message = constants.LOGIN_ERRMSG_HOME_REALM
+		}
+		showProviderChooser(c, http.StatusOK, message)
+		return
 	}
+	utils.SetAPMLabel(span, constants.LOGIN_PROVIDER_PARAM, provider.Name)
 
-	if isLoggedIn && !utils.IsTrue(renew) {
-		redirectToService(c, serviceURL, username, "", false)
+	if !provider.Authenticator.Available() {
+		showMaintenance(c)
+		return
+	}
+
+	if useLoginForm(serviceURL) {
+		if passive {
+			c.Redirect(http.StatusSeeOther, serviceURL)
+			return
+		}
+
+		showLoginForm(c, http.StatusOK, provider.Name, serviceURL, renew, "")
 		return
 	}
 
 	if config.AppConfig.AuthMethod == constants.OAUTH_METHOD {
 		encryptedServiceURL, _ := utils.Encrypt(config.AppConfig.SecureCookie, serviceURL)
 
-		setCookie(c, constants.SERVICE_URL_COOKIE, encryptedServiceURL, config.AppConfig.Domain, 3600)
+		// A form POST from the provider is cross-site, so the browser only sends SameSite=None cookies with it
+		setAuthCookie := setCookie
+		if provider.Authenticator.UsesFormPost() {
+			setAuthCookie = setCrossSiteCookie
+		}
 
-		config.AuthProvider.RedirectAuth(c)
+		setAuthCookie(c, constants.SERVICE_URL_COOKIE, encryptedServiceURL, config.AppConfig.Domain, 3600)
+
+		// renew and gateway are forwarded to the provider, which holds its own session
+		authRequest := auth.NewAuthRequest()
+		authRequest.Provider = provider.Name
+		authRequest.LoginHint = loginHint
+		authRequest.Renew = utils.IsTrue(renew)
+		authRequest.Gateway = utils.IsTrue(gateway) && !authRequest.Renew
+		encryptedAuthRequest, err := utils.EncodeCookie(config.AppConfig.SecureCookie, constants.AUTH_REQUEST_COOKIE, authRequest)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_STATE})
+			return
+		}
+
+		setAuthCookie(c, constants.AUTH_REQUEST_COOKIE, encryptedAuthRequest, config.AppConfig.Domain, int(auth.AuthRequestLifetime.Seconds()))
+
+		provider.Authenticator.RedirectAuth(c, authRequest)
 		return
 	}
 }
 
-func isLoggedIn(c *gin.Context, tgtName string) (bool, string) {
+func isLoggedIn(c *gin.Context, tgtName string) (bool, *database.TicketGrantingTicket, error) {
 	tgtCookie, err := c.Cookie(tgtName)
 	if err != nil {
-		return false, ""
+		return false, nil, nil
 	}
 
 	return utils.ValidateTGT(tgtCookie)
 }
+
+// refreshSession checks the upstream session of an old TGT with its refresh token, at most once every
+// RefreshInterval minutes. When the provider refuses the refresh, or is no longer configured, the TGT is deleted
+// and false is returned, so the user has to log in again. Other errors keep the session, the provider may be briefly unavailable.
+func refreshSession(c *gin.Context, session *database.TicketGrantingTicket) bool {
+	provider := sessionProvider(session)
+	if provider == nil {
+		log.Printf("Provider %q of the session of %s is no longer configured", session.Provider, session.Username)
+		endSession(c, session)
+		return false
+	}
+
+	interval := time.Duration(config.AppConfig.RefreshInterval) * time.Minute
+	if interval <= 0 || session.RefreshToken == "" || time.Since(session.RefreshedAt) < interval {
+		return true
+	}
+
+	var refreshToken string
+	err := utils.DecodeCookie(config.AppConfig.TokenCipher, constants.REFRESH_TOKEN_NAME, session.RefreshToken, &refreshToken)
+	if err != nil {
+		log.Printf("Error decrypting refresh token: %v", err)
+		return true
+	}
+
+	token, err := provider.Authenticator.Refresh(c, refreshToken)
+	if err != nil {
+		if !auth.IsRevoked(err) {
+			log.Printf("Error refreshing upstream session: %v", err)
+			return true
+		}
+
+		log.Printf("Upstream session of %s was revoked: %v", session.Username, err)
+		endSession(c, session)
+		return false
+	}
+
+	encryptedRefreshToken := session.RefreshToken
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		if encryptedRefreshToken, err = encryptRefreshToken(token.RefreshToken); err != nil {
+			log.Printf("Error encrypting refresh token: %v", err)
+			return true
+		}
+	}
+
+	if err := utils.UpdateTGTRefresh(session.TGT, encryptedRefreshToken, time.Now()); err != nil {
+		log.Printf("Error saving refreshed session: %v", err)
+	}
+
+	return true
+}
+
+func endSession(c *gin.Context, session *database.TicketGrantingTicket) {
+	_ = utils.DeleteTGT(session.TGT)
+	unsetCookie(c, config.AppConfig.TGTName, config.AppConfig.Domain)
+}
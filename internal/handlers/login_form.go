@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/internal/auth"
+	"cas-to-oauth2/internal/utils"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useLoginForm reports whether the user must type the credentials in our own login form,
+// instead of being redirected to the OAuth2 provider, for the given service.
+func useLoginForm(serviceURL string) bool {
+	if config.AppConfig.LoginMode == constants.LOGIN_MODE_FORM {
+		return true
+	}
+
+	return serviceURL != "" && matchesDomain(serviceURL, config.AppConfig.FormLoginDomains)
+}
+
+// loginCSRF is stored in the loginCSRF cookie. Its token is accepted once, until it expires.
+type loginCSRF struct {
+	Token   string
+	Expires time.Time
+}
+
+// consumedCSRFTokens holds the CSRF tokens of the forms already posted, until they expire.
+var consumedCSRFTokens = auth.NewReplayCache()
+
+// showLoginForm renders the credential form with a new CSRF token bound to the browser.
+func showLoginForm(c *gin.Context, status int, providerName, serviceURL, renew, message string) {
+	csrf := loginCSRF{Token: utils.RandomString(32), Expires: time.Now().Add(auth.AuthRequestLifetime)}
+	encryptedCSRFToken, err := utils.EncodeCookie(config.AppConfig.SecureCookie, constants.LOGIN_CSRF_COOKIE, csrf)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.LOGIN_ERRMSG_CSRF})
+		return
+	}
+
+	setCookie(c, constants.LOGIN_CSRF_COOKIE, encryptedCSRFToken, config.AppConfig.Domain, int(auth.AuthRequestLifetime.Seconds()))
+
+	c.HTML(status, constants.LOGIN_FORM_HTML, gin.H{
+		constants.TEMPLATE_MESSAGE:  message,
+		constants.TEMPLATE_ACTION:   constants.ENDPOINT_LOGIN,
+		constants.TEMPLATE_PROVIDER: providerName,
+		constants.TEMPLATE_SERVICE:  serviceURL,
+		constants.TEMPLATE_RENEW:    renew,
+		constants.TEMPLATE_CSRF:     csrf.Token,
+	})
+}
+
+// credentialLogin handles the credential form posted to the login endpoint. The credentials are
+// checked with the OAuth2 provider and, on success, a TGT is created as in the redirect flow.
+// Parameters from body (form encoded):
+//   - username, password: The user credentials.
+//   - csrf_token: The token rendered in the form, it must match the one stored in the loginCSRF cookie.
+//   - service(optional): URL of the service where the user intends to be redirected after authentication.
+//   - provider(optional): Name of the provider checking the credentials, selected as in the login page.
+func credentialLogin(c *gin.Context) {
+	span, ctx := utils.StartAPMSpan(c.Request.Context(), config.AppConfig.UseAPM, utils.GetFunctionName(), "")
+	defer utils.EndAPMSpan(span)
+
+	serviceURL := c.PostForm(constants.COMMON_SERVICE_PARAM)
+	renew := c.DefaultPostForm(constants.COMMON_RENEW_PARAM, "false")
+	utils.SetAPMLabel(span, constants.COMMON_SERVICE_PARAM, serviceURL)
+
+	if !useLoginForm(serviceURL) {
+		c.HTML(http.StatusForbidden, constants.UNAUTHORIZED_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.LOGIN_ERRMSG_FORM_DISABLED})
+		return
+	}
+
+	provider, _ := selectProvider(c.PostForm(constants.LOGIN_PROVIDER_PARAM), serviceURL)
+	if provider == nil {
+		c.HTML(http.StatusBadRequest, constants.UNAUTHORIZED_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.LOGIN_ERRMSG_PROVIDER})
+		return
+	}
+
+	if !consumeCSRFToken(c) {
+		showLoginForm(c, http.StatusForbidden, provider.Name, serviceURL, renew, constants.LOGIN_ERRMSG_CSRF)
+		return
+	}
+
+	username := c.PostForm(constants.LOGIN_USERNAME_PARAM)
+	password := c.PostForm(constants.LOGIN_PASSWORD_PARAM)
+	if username == "" || password == "" {
+		showLoginForm(c, http.StatusBadRequest, provider.Name, serviceURL, renew, constants.LOGIN_ERRMSG_MISSING)
+		return
+	}
+
+	token, err := provider.Authenticator.Authenticate(c, username, password)
+	if err != nil {
+		log.Printf("Credential login failed for %s: %v", username, err)
+		if auth.IsRevoked(err) {
+			showLoginForm(c, http.StatusUnauthorized, provider.Name, serviceURL, renew, constants.LOGIN_ERRMSG_CREDENTIALS)
+			return
+		}
+		if errors.Is(err, auth.ErrCircuitOpen) {
+			showMaintenance(c)
+			return
+		}
+		c.HTML(http.StatusBadGateway, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_UNAVAILABLE})
+		return
+	}
+
+	// The password grant has no authorization request, so the ID token carries no nonce
+	authRequest := &auth.AuthRequest{IssuedAt: time.Now()}
+	utils.SetAPMUsername(span, ctx, createSession(c, provider, token, authRequest, serviceURL))
+}
+
+// consumeCSRFToken checks the token posted with the form against the loginCSRF cookie and marks it
+// as used, so a copy of the cookie and the form is rejected even when the browser did not remove it.
+func consumeCSRFToken(c *gin.Context) bool {
+	encryptedCSRFToken, err := c.Cookie(constants.LOGIN_CSRF_COOKIE)
+	if err != nil {
+		return false
+	}
+	unsetCookie(c, constants.LOGIN_CSRF_COOKIE, config.AppConfig.Domain)
+
+	var csrf loginCSRF
+	err = utils.DecodeCookie(config.AppConfig.SecureCookie, constants.LOGIN_CSRF_COOKIE, encryptedCSRFToken, &csrf)
+	if err != nil || csrf.Token == "" || time.Now().After(csrf.Expires) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(csrf.Token), []byte(c.PostForm(constants.LOGIN_CSRF_PARAM))) == 1 &&
+		consumedCSRFTokens.Use(csrf.Token, csrf.Expires)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/internal/auth"
+	"cas-to-oauth2/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// newTokenEndpoint returns a token endpoint answering every password grant with the status and body,
+// and the number of requests it received.
+func newTokenEndpoint(t *testing.T, status int, body string) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "password" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// setupFormLogin configures the login form with a provider whose token endpoint is the given server.
+func setupFormLogin(t *testing.T, tokenURL string) {
+	authenticator := auth.NewOAuth2Authenticator(oauth2.Config{
+		ClientID: "cas-client",
+		Endpoint: oauth2.Endpoint{TokenURL: tokenURL, AuthStyle: oauth2.AuthStyleInParams},
+	}, nil)
+	setupConfig(t, &config.Provider{Name: constants.AUTH_DEFAULT_PROVIDER, Authenticator: authenticator})
+	config.AppConfig.LoginMode = constants.LOGIN_MODE_FORM
+}
+
+func encodeCSRF(t *testing.T, csrf loginCSRF) string {
+	t.Helper()
+	encoded, err := utils.EncodeCookie(config.AppConfig.SecureCookie, constants.LOGIN_CSRF_COOKIE, csrf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// postLogin posts the login form with the CSRF token and, unless it is empty, the loginCSRF cookie.
+func postLogin(token, cookie string) *httptest.ResponseRecorder {
+	form := url.Values{
+		constants.LOGIN_USERNAME_PARAM: {"jdoe"},
+		constants.LOGIN_PASSWORD_PARAM: {"secret"},
+		constants.LOGIN_CSRF_PARAM:     {token},
+	}
+	req := httptest.NewRequest(http.MethodPost, constants.ENDPOINT_LOGIN, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: constants.LOGIN_CSRF_COOKIE, Value: cookie})
+	}
+
+	c, recorder := newContext(req)
+	Login(c)
+	return recorder
+}
+
+func TestCredentialLoginCSRF(t *testing.T) {
+	server, requests := newTokenEndpoint(t, http.StatusBadRequest, `{"error":"invalid_grant"}`)
+	setupFormLogin(t, server.URL)
+
+	newCSRF := func(expires time.Duration) loginCSRF {
+		return loginCSRF{Token: utils.RandomString(32), Expires: time.Now().Add(expires)}
+	}
+	valid := newCSRF(time.Minute)
+	expired := newCSRF(-time.Second)
+	mismatched := newCSRF(time.Minute)
+
+	tests := []struct {
+		name   string
+		token  string
+		cookie string
+		want   int
+	}{
+		{"missing cookie", valid.Token, "", http.StatusForbidden},
+		{"missing token", "", encodeCSRF(t, valid), http.StatusForbidden},
+		{"mismatched token", "another-token", encodeCSRF(t, mismatched), http.StatusForbidden},
+		{"expired cookie", expired.Token, encodeCSRF(t, expired), http.StatusForbidden},
+		{"tampered cookie", valid.Token, encodeCSRF(t, valid) + "x", http.StatusForbidden},
+		{"valid token", valid.Token, encodeCSRF(t, valid), http.StatusUnauthorized},
+		{"reused token", valid.Token, encodeCSRF(t, valid), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := atomic.LoadInt32(requests)
+			recorder := postLogin(tt.token, tt.cookie)
+			if recorder.Code != tt.want {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.want)
+			}
+
+			// A rejected form is never sent to the provider, and comes back with a new CSRF token
+			if tt.want == http.StatusForbidden {
+				if atomic.LoadInt32(requests) != before {
+					t.Fatal("credentials sent to the provider with an invalid CSRF token")
+				}
+				if !strings.Contains(recorder.Body.String(), constants.LOGIN_ERRMSG_CSRF) {
+					t.Fatalf("body does not show %q:\n%s", constants.LOGIN_ERRMSG_CSRF, recorder.Body)
+				}
+				if cookie := responseCookie(recorder, constants.LOGIN_CSRF_COOKIE); cookie == nil || cookie.Value == "" {
+					t.Fatal("no new loginCSRF cookie set")
+				}
+			}
+		})
+	}
+}
+
+func TestCredentialLoginProviderErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		want        int
+		wantMessage string
+	}{
+		{"invalid_grant", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"Invalid user credentials"}`, http.StatusUnauthorized, constants.LOGIN_ERRMSG_CREDENTIALS},
+		{"invalid_grant with 401", http.StatusUnauthorized, `{"error":"invalid_grant"}`, http.StatusUnauthorized, constants.LOGIN_ERRMSG_CREDENTIALS},
+		{"other client error", http.StatusUnauthorized, `{"error":"invalid_client"}`, http.StatusBadGateway, constants.OAUTH_ERRMSG_UNAVAILABLE},
+		{"server error", http.StatusInternalServerError, `{"error":"server_error"}`, http.StatusBadGateway, constants.OAUTH_ERRMSG_UNAVAILABLE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newTokenEndpoint(t, tt.status, tt.body)
+			setupFormLogin(t, server.URL)
+
+			csrf := loginCSRF{Token: utils.RandomString(32), Expires: time.Now().Add(time.Minute)}
+			recorder := postLogin(csrf.Token, encodeCSRF(t, csrf))
+			if recorder.Code != tt.want {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.want)
+			}
+			if !strings.Contains(recorder.Body.String(), tt.wantMessage) {
+				t.Fatalf("body does not show %q:\n%s", tt.wantMessage, recorder.Body)
+			}
+			if cookie := responseCookie(recorder, config.AppConfig.TGTName); cookie != nil {
+				t.Fatal("TGT cookie set after a failed login")
+			}
+		})
+	}
+}
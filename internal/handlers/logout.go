@@ -4,6 +4,7 @@ import (
 	"cas-to-oauth2/config"
 	"cas-to-oauth2/constants"
 	"cas-to-oauth2/internal/utils"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -15,10 +16,12 @@ import (
 //   - TGTName: A cookie containing the Ticket Granting Ticket, used for CAS authentication.
 //
 // Query string parameters (optional):
-//   - url(optional): A URL to redirect the user to after successful logout.
+//   - url(optional): A URL to redirect the user to after successful logout, ignored unless its domain is allowed.
+//   - service(optional): Used as the redirection URL when url is not present.
 //
 // Returns:
-//   - Depending on the outcome, the function may redirect the user to a specified URL
+//   - Depending on the outcome, the function may redirect the user to a specified URL,
+//     to the end_session_endpoint of the OAuth2 provider when upstream logout is enabled,
 //     or render a confirmation message of successful logout.
 func Logout(c *gin.Context) {
 	span, _ := utils.StartAPMSpan(c.Request.Context(), config.AppConfig.UseAPM, utils.GetFunctionName(), "")
@@ -33,6 +36,18 @@ func Logout(c *gin.Context) {
 		return
 	}
 
+	var idToken string
+	var provider *config.Provider
+	isValid, session, err := utils.ValidateTGT(tgtCookie)
+	if err != nil {
+		// The TGT is still deleted below, only the logout at the provider is lost
+		log.Printf("Error validating TGT: %v", err)
+	}
+	if isValid {
+		idToken = session.IDToken
+		provider = sessionProvider(session)
+	}
+
 	err = utils.DeleteTGT(tgtCookie)
 	if err != nil {
 		c.HTML(http.StatusBadRequest, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.LOGOUT_ERRMSG_DELETE_TGT})
@@ -46,13 +61,26 @@ func Logout(c *gin.Context) {
 		unsetCookie(c, config.AppConfig.AnotherCookie, config.AppConfig.Domain)
 	}
 
-	if url := c.Query(constants.LOGOUT_REDIRECT_PARAM); url != "" {
-		c.Redirect(http.StatusFound, url)
-		return
+	redirectURL := c.Query(constants.LOGOUT_REDIRECT_PARAM)
+	if redirectURL == "" {
+		redirectURL = c.Query(constants.COMMON_SERVICE_PARAM)
+	}
+
+	// Like on login, only allowed services are redirected to, also through the provider
+	if redirectURL != "" && !checkAllowedDomains(redirectURL) {
+		log.Printf("Ignoring logout redirection to a service that is not allowed: %s", redirectURL)
+		redirectURL = ""
+	}
+
+	if provider != nil {
+		if logoutURL := provider.Authenticator.LogoutURL(idToken, redirectURL); logoutURL != "" {
+			c.Redirect(http.StatusFound, logoutURL)
+			return
+		}
 	}
 
-	if url := c.Query(constants.COMMON_SERVICE_PARAM); url != "" {
-		c.Redirect(http.StatusFound, url)
+	if redirectURL != "" {
+		c.Redirect(http.StatusFound, redirectURL)
 		return
 	}
 
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/database"
+	"cas-to-oauth2/internal/auth"
+	"cas-to-oauth2/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestLogoutRedirect(t *testing.T) {
+	const defaultRedirect = "https://cas.example.edu/login"
+
+	tests := []struct {
+		name           string
+		upstreamLogout bool
+		query          url.Values
+		want           string
+	}{
+		{"allowed url to the provider", true, url.Values{"url": {"https://service.example.edu/bye"}}, "https://service.example.edu/bye"},
+		{"allowed service to the provider", true, url.Values{"service": {"https://service.example.edu/"}}, "https://service.example.edu/"},
+		{"not allowed url to the provider", true, url.Values{"url": {"https://evil.example.com/"}}, defaultRedirect},
+		{"not allowed service to the provider", true, url.Values{"service": {"https://evil.example.com/"}}, defaultRedirect},
+		{"no redirection to the provider", true, nil, defaultRedirect},
+		{"allowed url", false, url.Values{"url": {"https://service.example.edu/bye"}}, "https://service.example.edu/bye"},
+		{"not allowed url", false, url.Values{"url": {"https://evil.example.com/"}}, constants.ENDPOINT_LOGIN},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := auth.NewOAuth2Authenticator(oauth2.Config{ClientID: "cas-client"}, nil)
+			authenticator.EndSessionURL = "https://idp.example.edu/logout"
+			authenticator.UpstreamLogout = tt.upstreamLogout
+			authenticator.PostLogoutRedirectURL = defaultRedirect
+			setupConfig(t, &config.Provider{Name: constants.AUTH_DEFAULT_PROVIDER, Authenticator: authenticator})
+			setupRegistry(t)
+
+			tgt, err := utils.GenerateTGT(config.AppConfig.TGTDuration, &database.TicketGrantingTicket{
+				Username: "jdoe",
+				Provider: constants.AUTH_DEFAULT_PROVIDER,
+				IDToken:  "id-token",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/logout?"+tt.query.Encode(), nil)
+			req.AddCookie(&http.Cookie{Name: config.AppConfig.TGTName, Value: tgt})
+			c, recorder := newContext(req)
+			Logout(c)
+
+			if recorder.Code != http.StatusFound {
+				t.Fatalf("got status %d, want %d", recorder.Code, http.StatusFound)
+			}
+			location, err := url.Parse(recorder.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := location.String()
+			if tt.upstreamLogout {
+				if location.Host != "idp.example.edu" {
+					t.Fatalf("not redirected to the provider: %s", location)
+				}
+				got = location.Query().Get("post_logout_redirect_uri")
+			}
+			if got != tt.want {
+				t.Fatalf("redirected to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -27,24 +27,24 @@ type ProxyResponse struct {
 	Failure *ProxyFailure `xml:"cas:proxyFailure,omitempty"`
 }
 
-type ProxyValidateResponse struct {
-	CommonResponse
-	Success *ProxyValidateSuccess `xml:"cas:authenticationSuccess,omitempty"`
-	Failure *ProxyValidateFailure `xml:"cas:authenticationFailure,omitempty"`
+type AuthenticationSuccess struct {
+	User                string         `xml:"cas:user"`
+	Attributes          *CASAttributes `xml:"cas:attributes,omitempty"`
+	ProxyGrantingTicket string         `xml:"cas:proxyGrantingTicket,omitempty"`
+	Proxies             []string       `xml:"cas:proxies>cas:proxy,omitempty"`
 }
 
-type AuthenticationSuccess struct {
-	User string `xml:"cas:user"`
+type CASAttributes struct {
+	Values []CASAttribute
 }
 
-type ProxySuccess struct {
-	ProxyTicket string `xml:"cas:proxyTicket"`
+type CASAttribute struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
 }
 
-type ProxyValidateSuccess struct {
-	User                string   `xml:"cas:user"`
-	ProxyGrantingTicket string   `xml:"cas:proxyGrantingTicket"`
-	Proxies             []string `xml:"cas:proxies>proxy"`
+type ProxySuccess struct {
+	ProxyTicket string `xml:"cas:proxyTicket"`
 }
 
 type SAMLRequest struct {
@@ -69,7 +69,6 @@ type Request struct {
 
 type AuthenticationFailure CommonFailure
 type ProxyFailure CommonFailure
-type ProxyValidateFailure CommonFailure
 
 type ResponseEnvelope struct {
 	XMLName xml.Name     `xml:"SOAP-ENV:Envelope"`
@@ -3,22 +3,32 @@ package handlers
 import (
 	"cas-to-oauth2/config"
 	"cas-to-oauth2/constants"
+	"cas-to-oauth2/database"
+	"cas-to-oauth2/internal/auth"
 	"cas-to-oauth2/internal/utils"
+	"errors"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
 )
 
 // OAuth2Callback handles the callback from the OAuth2 provider after user authentication.
-// It processes the request based on query string parameters and cookies.
-// Parameters from query string:
+// Every provider has its own callback path, only the authorization requests sent to that provider are accepted.
+// It processes the request based on query string parameters, or form parameters when the provider
+// uses response_mode=form_post, and cookies.
+// Parameters from query string or body (form encoded):
 //   - code: The authorization code returned by the OAuth2 provider.
+//   - state: The state sent in the authorization request, it must match the one stored in the authRequest cookie.
+//   - error, error_description, error_uri: Sent by the OAuth2 provider instead of code when the authorization failed.
 //
 // Cookies:
 //   - serviceUrl: A cookie containing the service url, used for redirection after successful authentication.
+//   - authRequest: A short-lived cookie binding the state and nonce of the authorization request to the browser.
 //
 // Returns:
 //   - Depending on the outcome of the OAuth2 token exchange and validation process,
@@ -27,49 +37,213 @@ func OAuth2Callback(c *gin.Context) {
 	span, ctx := utils.StartAPMSpan(c.Request.Context(), config.AppConfig.UseAPM, utils.GetFunctionName(), constants.OAUTH_ERRMSG_SPAN)
 	defer utils.EndAPMSpan(span)
 
-	code := c.DefaultQuery(constants.OAUTH_CODE_PARAM, "")
+	provider := callbackProvider(c)
+	if provider == nil {
+		c.HTML(http.StatusNotFound, constants.UNAUTHORIZED_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.LOGIN_ERRMSG_PROVIDER})
+		return
+	}
+
+	authRequest, ok := consumeAuthRequest(c, provider)
+
+	if errorCode := callbackParam(c, constants.OAUTH_ERROR_PARAM); errorCode != "" {
+		handleProviderError(c, errorCode, authRequest)
+		return
+	}
+
+	if !ok {
+		c.HTML(http.StatusBadRequest, constants.UNAUTHORIZED_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_STATE})
+		return
+	}
+
+	code := callbackParam(c, constants.OAUTH_CODE_PARAM)
 	if code == "" {
 		c.HTML(http.StatusBadRequest, constants.UNAUTHORIZED_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_UNAUTHORIZED})
 		return
 	}
 
-	token, err := config.AuthProvider.Exchange(c, code)
+	token, err := provider.Authenticator.Exchange(c, code, authRequest)
+	if errors.Is(err, auth.ErrCircuitOpen) {
+		showMaintenance(c)
+		return
+	}
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_EXCHANGE})
 		return
 	}
 
+	username := createSession(c, provider, token, authRequest, consumeServiceURL(c))
+	utils.SetAPMUsername(span, ctx, username)
+}
+
+// createSession verifies the token response of the provider, creates the TGT of the user and sends
+// the user to the service. It returns the username, or an empty string when an error page was rendered.
+func createSession(c *gin.Context, provider *config.Provider, token *oauth2.Token, authRequest *auth.AuthRequest, serviceURL string) string {
 	if !token.Valid() {
 		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_INVALID_TOKEN})
-		return
+		return ""
+	}
+
+	claims, err := provider.Authenticator.VerifyToken(token, authRequest)
+	if err != nil {
+		log.Printf("ID token verification failed: %v", err)
+		c.HTML(http.StatusUnauthorized, constants.UNAUTHORIZED_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_VERIFY})
+		return ""
+	}
+
+	claims, err = provider.Authenticator.UserInfo(c, token, claims)
+	if err != nil {
+		log.Printf("Error fetching UserInfo: %v", err)
+		if errors.Is(err, auth.ErrCircuitOpen) {
+			showMaintenance(c)
+			return ""
+		}
+		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_USERINFO})
+		return ""
 	}
 
-	sub, err := utils.GetSubjectFromToken(token)
+	attributes := utils.GetAttributesFromClaims(claims)
+	username, err := config.AppConfig.PrincipalResolver.Resolve(attributes)
 	if err != nil {
+		log.Printf("Error resolving principal: %v", err)
 		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_SUB})
-		return
+		return ""
 	}
 
-	utils.SetAPMUsername(span, ctx, sub)
+	idToken, _ := token.Extra(constants.AUTH_ID_TOKEN).(string)
+	subject, _ := claims[constants.AUTH_SUBJECT_CLAIM].(string)
+	sessionID, _ := claims[constants.AUTH_SESSION_ID_CLAIM].(string)
+	refreshToken, err := encryptRefreshToken(token.RefreshToken)
+	if err != nil {
+		log.Printf("Error encrypting refresh token: %v", err)
+	}
 
-	tgt := utils.GenerateTGT(config.AppConfig.TGTDuration, sub)
+	tgt, err := utils.GenerateTGT(config.AppConfig.TGTDuration, &database.TicketGrantingTicket{
+		Username:     username,
+		Attributes:   attributes,
+		Provider:     provider.Name,
+		IDToken:      idToken,
+		Subject:      subject,
+		SessionID:    sessionID,
+		RefreshToken: refreshToken,
+		RefreshedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error storing TGT: %v", err)
+		c.HTML(http.StatusInternalServerError, constants.ERROR_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.COMMON_ERRMSG_REGISTRY})
+		return ""
+	}
 	setCookie(c, config.AppConfig.TGTName, tgt, config.AppConfig.Domain, config.AppConfig.TGTDuration)
 
-	encryptedServiceURL, err := c.Cookie(constants.SERVICE_URL_COOKIE)
-	unsetCookie(c, constants.SERVICE_URL_COOKIE, config.AppConfig.Domain)
-
-	serviceURL, _ := utils.Decrypt(config.AppConfig.SecureCookie, encryptedServiceURL)
 	if serviceURL != "" {
 		action := getAction(serviceURL)
 		if action != nil {
 			action(c)
 		}
 
-		redirectToService(c, serviceURL, sub, tgt, true)
-		return
+		redirectToService(c, serviceURL, username, attributes, tgt, true)
+		return username
 	}
 
 	c.HTML(http.StatusCreated, constants.LOGIN_HTML, gin.H{constants.TEMPLATE_MESSAGE: constants.OAUTH_ERRMSG_OK})
+	return username
+}
+
+// consumeAuthRequest reads the authorization request bound to the browser and removes it,
+// so the same state can not be used twice. A request sent to another provider is rejected.
+func consumeAuthRequest(c *gin.Context, provider *config.Provider) (*auth.AuthRequest, bool) {
+	encryptedAuthRequest, err := c.Cookie(constants.AUTH_REQUEST_COOKIE)
+	if err != nil {
+		return nil, false
+	}
+	unsetCookie(c, constants.AUTH_REQUEST_COOKIE, config.AppConfig.Domain)
+
+	var authRequest auth.AuthRequest
+	err = utils.DecodeCookie(config.AppConfig.SecureCookie, constants.AUTH_REQUEST_COOKIE, encryptedAuthRequest, &authRequest)
+	if err != nil {
+		return nil, false
+	}
+
+	if authRequest.Provider != provider.Name || !authRequest.Consume(callbackParam(c, constants.OAUTH_STATE_PARAM)) {
+		return nil, false
+	}
+
+	return &authRequest, true
+}
+
+// callbackParam reads a callback parameter from the body of a form_post callback, or from the query string.
+func callbackParam(c *gin.Context, name string) string {
+	if c.Request.Method == http.MethodPost {
+		return c.PostForm(name)
+	}
+	return c.Query(name)
+}
+
+func encryptRefreshToken(refreshToken string) (string, error) {
+	if refreshToken == "" {
+		return "", nil
+	}
+	return utils.EncodeCookie(config.AppConfig.TokenCipher, constants.REFRESH_TOKEN_NAME, refreshToken)
+}
+
+// consumeServiceURL reads the service URL saved before the redirection to the provider and removes it.
+func consumeServiceURL(c *gin.Context) string {
+	encryptedServiceURL, _ := c.Cookie(constants.SERVICE_URL_COOKIE)
+	unsetCookie(c, constants.SERVICE_URL_COOKIE, config.AppConfig.Domain)
+
+	serviceURL, _ := utils.Decrypt(config.AppConfig.SecureCookie, encryptedServiceURL)
+	return serviceURL
+}
+
+type providerError struct {
+	status   int
+	template string
+	message  string
+}
+
+// providerErrors maps the error codes of RFC 6749 and OpenID Connect to the page shown to the user.
+var providerErrors = map[string]providerError{
+	constants.OAUTH_ERROR_ACCESS_DENIED:              {http.StatusForbidden, constants.UNAUTHORIZED_HTML, constants.OAUTH_ERRMSG_ACCESS_DENIED},
+	constants.OAUTH_ERROR_LOGIN_REQUIRED:             {http.StatusUnauthorized, constants.UNAUTHORIZED_HTML, constants.OAUTH_ERRMSG_LOGIN_REQUIRED},
+	constants.OAUTH_ERROR_INTERACTION_REQUIRED:       {http.StatusUnauthorized, constants.UNAUTHORIZED_HTML, constants.OAUTH_ERRMSG_LOGIN_REQUIRED},
+	constants.OAUTH_ERROR_CONSENT_REQUIRED:           {http.StatusUnauthorized, constants.UNAUTHORIZED_HTML, constants.OAUTH_ERRMSG_LOGIN_REQUIRED},
+	constants.OAUTH_ERROR_ACCOUNT_SELECTION_REQUIRED: {http.StatusUnauthorized, constants.UNAUTHORIZED_HTML, constants.OAUTH_ERRMSG_LOGIN_REQUIRED},
+	constants.OAUTH_ERROR_TEMPORARILY_UNAVAILABLE:    {http.StatusServiceUnavailable, constants.ERROR_HTML, constants.OAUTH_ERRMSG_UNAVAILABLE},
+	constants.OAUTH_ERROR_SERVER_ERROR:               {http.StatusBadGateway, constants.ERROR_HTML, constants.OAUTH_ERRMSG_UNAVAILABLE},
+}
+
+// handleProviderError answers an error redirection from the OAuth2 provider. The error is logged
+// for support and the user gets either a page explaining it or, for a gateway request, the service.
+func handleProviderError(c *gin.Context, errorCode string, authRequest *auth.AuthRequest) {
+	log.Printf("OAuth2 provider returned error %q: %s %s", errorCode,
+		callbackParam(c, constants.OAUTH_ERROR_DESCRIPTION_PARAM), callbackParam(c, constants.OAUTH_ERROR_URI_PARAM))
+
+	// With gateway the user is sent back to the service without a ticket when the provider has no session.
+	// A missing service URL, or one no longer allowed, gets the error page instead.
+	serviceURL := consumeServiceURL(c)
+	if authRequest != nil && authRequest.Gateway && isPassiveLoginError(errorCode) &&
+		serviceURL != "" && checkAllowedDomains(serviceURL) {
+		c.Redirect(http.StatusSeeOther, serviceURL)
+		return
+	}
+
+	page, ok := providerErrors[errorCode]
+	if !ok {
+		// Remaining codes (invalid_request, unauthorized_client, invalid_scope...) are configuration problems
+		page = providerError{http.StatusInternalServerError, constants.ERROR_HTML, constants.OAUTH_ERRMSG_PROVIDER}
+	}
+
+	c.HTML(page.status, page.template, gin.H{constants.TEMPLATE_MESSAGE: page.message})
+}
+
+// isPassiveLoginError reports whether the provider refused a prompt=none request because it
+// needs to interact with the user.
+func isPassiveLoginError(errorCode string) bool {
+	switch errorCode {
+	case constants.OAUTH_ERROR_LOGIN_REQUIRED, constants.OAUTH_ERROR_INTERACTION_REQUIRED,
+		constants.OAUTH_ERROR_CONSENT_REQUIRED, constants.OAUTH_ERROR_ACCOUNT_SELECTION_REQUIRED:
+		return true
+	}
+	return false
 }
 
 type Rule struct {
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/internal/auth"
+	"cas-to-oauth2/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// callbackRequest returns a callback request with the state and, unless it is empty, the authRequest cookie.
+func callbackRequest(state, cookie string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/callback?"+url.Values{constants.OAUTH_STATE_PARAM: {state}}.Encode(), nil)
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: constants.AUTH_REQUEST_COOKIE, Value: cookie})
+	}
+	return req
+}
+
+func encodeAuthRequest(t *testing.T, authRequest *auth.AuthRequest) string {
+	t.Helper()
+	encoded, err := utils.EncodeCookie(config.AppConfig.SecureCookie, constants.AUTH_REQUEST_COOKIE, authRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestConsumeAuthRequest(t *testing.T) {
+	provider := &config.Provider{Name: constants.AUTH_DEFAULT_PROVIDER}
+	setupConfig(t, provider)
+
+	newRequest := func(change func(*auth.AuthRequest)) *auth.AuthRequest {
+		authRequest := auth.NewAuthRequest()
+		authRequest.Provider = provider.Name
+		if change != nil {
+			change(authRequest)
+		}
+		return authRequest
+	}
+
+	valid := newRequest(nil)
+	expired := newRequest(func(a *auth.AuthRequest) { a.Expires = time.Now().Add(-time.Second) })
+	otherProvider := newRequest(func(a *auth.AuthRequest) { a.Provider = "staff" })
+	mismatched := newRequest(nil)
+
+	tests := []struct {
+		name   string
+		state  string
+		cookie string
+		want   bool
+	}{
+		{"matching state", valid.State, encodeAuthRequest(t, valid), true},
+		{"replay of the consumed cookie", valid.State, encodeAuthRequest(t, valid), false},
+		{"state mismatch", "another-state", encodeAuthRequest(t, mismatched), false},
+		{"expired cookie", expired.State, encodeAuthRequest(t, expired), false},
+		{"request of another provider", otherProvider.State, encodeAuthRequest(t, otherProvider), false},
+		{"tampered cookie", valid.State, encodeAuthRequest(t, valid) + "x", false},
+		{"no cookie", valid.State, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, recorder := newContext(callbackRequest(tt.state, tt.cookie))
+
+			authRequest, ok := consumeAuthRequest(c, provider)
+			if ok != tt.want {
+				t.Fatalf("consumeAuthRequest() = %v, want %v", ok, tt.want)
+			}
+			if ok && authRequest.Nonce != valid.Nonce {
+				t.Fatalf("got nonce %q, want %q", authRequest.Nonce, valid.Nonce)
+			}
+
+			// The cookie is removed whenever the browser sent one, so it can not be used again
+			if cookie := responseCookie(recorder, constants.AUTH_REQUEST_COOKIE); tt.cookie != "" && (cookie == nil || cookie.MaxAge >= 0) {
+				t.Fatalf("authRequest cookie not removed: %v", cookie)
+			}
+		})
+	}
+}
+
+func TestOAuth2CallbackRejectsStateMismatch(t *testing.T) {
+	provider := &config.Provider{Name: constants.AUTH_DEFAULT_PROVIDER}
+	setupConfig(t, provider)
+
+	authRequest := auth.NewAuthRequest()
+	authRequest.Provider = provider.Name
+	req := callbackRequest("another-state", encodeAuthRequest(t, authRequest))
+	req.URL.RawQuery += "&" + constants.OAUTH_CODE_PARAM + "=code"
+
+	c, recorder := newContext(req)
+	OAuth2Callback(c)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOAuth2CallbackProviderError(t *testing.T) {
+	const serviceURL = "https://service.example.edu/app"
+
+	tests := []struct {
+		name         string
+		gateway      bool
+		errorCode    string
+		serviceURL   string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"gateway with login_required", true, "login_required", serviceURL, http.StatusSeeOther, serviceURL},
+		{"gateway with interaction_required", true, "interaction_required", serviceURL, http.StatusSeeOther, serviceURL},
+		{"gateway with access_denied", true, "access_denied", serviceURL, http.StatusForbidden, ""},
+		{"gateway without service URL", true, "login_required", "", http.StatusUnauthorized, ""},
+		{"gateway to a service not allowed", true, "login_required", "https://evil.example.com/", http.StatusUnauthorized, ""},
+		{"login_required without gateway", false, "login_required", serviceURL, http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &config.Provider{Name: constants.AUTH_DEFAULT_PROVIDER}
+			setupConfig(t, provider)
+
+			authRequest := auth.NewAuthRequest()
+			authRequest.Provider = provider.Name
+			authRequest.Gateway = tt.gateway
+			req := callbackRequest(authRequest.State, encodeAuthRequest(t, authRequest))
+			req.URL.RawQuery += "&" + constants.OAUTH_ERROR_PARAM + "=" + tt.errorCode
+			if tt.serviceURL != "" {
+				encryptedServiceURL, err := utils.Encrypt(config.AppConfig.SecureCookie, tt.serviceURL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.AddCookie(&http.Cookie{Name: constants.SERVICE_URL_COOKIE, Value: encryptedServiceURL})
+			}
+
+			c, recorder := newContext(req)
+			OAuth2Callback(c)
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", recorder.Code, tt.wantStatus)
+			}
+
+			// The service gets the user back without a ticket, as CAS gateway requires
+			if location := recorder.Header().Get("Location"); location != tt.wantLocation {
+				t.Fatalf("got Location %q, want %q", location, tt.wantLocation)
+			}
+			if cookie := responseCookie(recorder, constants.SERVICE_URL_COOKIE); cookie == nil || cookie.MaxAge >= 0 {
+				t.Fatalf("serviceURL cookie not removed: %v", cookie)
+			}
+		})
+	}
+}
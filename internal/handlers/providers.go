@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/database"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type providerChoice struct {
+	Label string
+	URL   string
+}
+
+// selectProvider picks the provider for a login request: the one named in the provider parameter,
+// else the one the service belongs to, else the only one configured. It returns nil when the
+// user has to choose, and false when the provider parameter names an unknown provider.
+func selectProvider(name, serviceURL string) (*config.Provider, bool) {
+	if name != "" {
+		provider := config.GetProvider(name)
+		return provider, provider != nil
+	}
+
+	if serviceURL != "" {
+		for _, provider := range config.Providers {
+			if matchesDomain(serviceURL, provider.ServiceDomains) {
+				return provider, true
+			}
+		}
+	}
+
+	if len(config.Providers) == 1 {
+		return config.Providers[0], true
+	}
+	return nil, true
+}
+
+// discoverProvider picks the provider for the email or username typed by the user with the home realm rules.
+// The most specific rule matching the domain of the hint, or one of its parent domains, wins.
+// Hints without a domain, and domains without a rule, use the * rule when there is one.
+func discoverProvider(hint string) *config.Provider {
+	_, domain, found := strings.Cut(strings.ToLower(strings.TrimSpace(hint)), "@")
+	for found && domain != "" {
+		if name, ok := config.AppConfig.HomeRealmRules[domain]; ok {
+			return config.GetProvider(name)
+		}
+		_, domain, found = strings.Cut(domain, ".")
+	}
+
+	if name, ok := config.AppConfig.HomeRealmRules[constants.AUTH_HOME_REALM_DEFAULT]; ok {
+		return config.GetProvider(name)
+	}
+	return nil
+}
+
+// showProviderChooser renders the list of providers, each one linking back to the login
+// endpoint with the same parameters and the provider chosen. With home realm rules configured
+// the page also asks for the email of the user, sent back to the login endpoint as login_hint.
+func showProviderChooser(c *gin.Context, status int, message string) {
+	var choices []providerChoice
+	for _, provider := range config.Providers {
+		query := c.Request.URL.Query()
+		query.Del(constants.AUTH_LOGIN_HINT_PARAM)
+		query.Set(constants.LOGIN_PROVIDER_PARAM, provider.Name)
+		loginURL := url.URL{Path: constants.ENDPOINT_LOGIN, RawQuery: query.Encode()}
+		choices = append(choices, providerChoice{Label: provider.Label, URL: loginURL.String()})
+	}
+
+	c.HTML(status, constants.PROVIDERS_HTML, gin.H{
+		constants.TEMPLATE_MESSAGE:   message,
+		constants.TEMPLATE_PROVIDERS: choices,
+		constants.TEMPLATE_DISCOVERY: len(config.AppConfig.HomeRealmRules) > 0,
+		constants.TEMPLATE_ACTION:    constants.ENDPOINT_LOGIN,
+		constants.TEMPLATE_SERVICE:   c.Query(constants.COMMON_SERVICE_PARAM),
+		constants.TEMPLATE_RENEW:     c.Query(constants.COMMON_RENEW_PARAM),
+		constants.TEMPLATE_GATEWAY:   c.Query(constants.COMMON_GATEWAY_PARAM),
+	})
+}
+
+// sessionProvider returns the provider a TGT was created with, or nil when it is no longer configured.
+func sessionProvider(session *database.TicketGrantingTicket) *config.Provider {
+	return config.GetProvider(session.Provider)
+}
+
+// callbackProvider returns the provider named in the path of a callback or back-channel logout request.
+// The plain paths belong to the first provider.
+func callbackProvider(c *gin.Context) *config.Provider {
+	return config.GetProvider(c.Param(constants.LOGIN_PROVIDER_PARAM))
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"testing"
+)
+
+// setupHomeRealm installs the providers and home realm rules, restored when the test ends.
+func setupHomeRealm(t *testing.T, rules map[string]string, providers ...*config.Provider) {
+	t.Helper()
+	rulesBefore, providersBefore := config.AppConfig.HomeRealmRules, config.Providers
+	t.Cleanup(func() {
+		config.AppConfig.HomeRealmRules, config.Providers = rulesBefore, providersBefore
+	})
+
+	config.AppConfig.HomeRealmRules = rules
+	config.Providers = providers
+}
+
+func TestDiscoverProvider(t *testing.T) {
+	staff := &config.Provider{Name: "staff"}
+	students := &config.Provider{Name: "students"}
+	social := &config.Provider{Name: "social"}
+
+	tests := []struct {
+		name  string
+		rules map[string]string
+		hint  string
+		want  *config.Provider
+	}{
+		{"exact domain", map[string]string{"example.edu": "staff"}, "jdoe@example.edu", staff},
+		{"domain is case insensitive", map[string]string{"example.edu": "staff"}, " JDoe@Example.EDU ", staff},
+		{"subdomain matches the parent domain", map[string]string{"example.edu": "staff"}, "jdoe@mail.example.edu", staff},
+		{"most specific domain wins", map[string]string{"example.edu": "staff", "students.example.edu": "students"}, "jdoe@students.example.edu", students},
+		{"deeper subdomain of the specific domain", map[string]string{"example.edu": "staff", "students.example.edu": "students"}, "jdoe@lab.students.example.edu", students},
+		{"suffix that is not a parent domain", map[string]string{"example.edu": "staff"}, "jdoe@badexample.edu", nil},
+		{"bare username uses *", map[string]string{"example.edu": "staff", "*": "social"}, "jdoe", social},
+		{"unknown domain uses *", map[string]string{"example.edu": "staff", "*": "social"}, "jdoe@gmail.com", social},
+		{"empty domain uses *", map[string]string{"example.edu": "staff", "*": "social"}, "jdoe@", social},
+		{"bare username without *", map[string]string{"example.edu": "staff"}, "jdoe", nil},
+		{"unknown domain without *", map[string]string{"example.edu": "staff"}, "jdoe@gmail.com", nil},
+		{"no rules", nil, "jdoe@example.edu", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupHomeRealm(t, tt.rules, staff, students, social)
+
+			if got := discoverProvider(tt.hint); got != tt.want {
+				t.Fatalf("discoverProvider(%q) = %v, want %v", tt.hint, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"cas-to-oauth2/constants"
+	"cas-to-oauth2/database"
 	"cas-to-oauth2/internal/utils"
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -45,8 +47,18 @@ func Proxy(c *gin.Context) {
 		return
 	}
 
-	proxyTicket := utils.GenerateProxyTicket(pgt, targetService)
-	if proxyTicket == "" {
+	proxyTicket, err := utils.GenerateProxyTicket(pgt, targetService)
+	if errors.Is(err, database.ErrTicketNotFound) {
+		c.XML(http.StatusUnauthorized, ProxyResponse{
+			Failure: &ProxyFailure{
+				Code:        "BAD_PGT",
+				Description: "The pgt provided was invalid",
+			},
+		})
+		return
+	}
+
+	if err != nil {
 		c.XML(http.StatusInternalServerError, ProxyResponse{
 			Failure: &ProxyFailure{
 				Code:        "INTERNAL_ERROR",
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/constants"
+	"cas-to-oauth2/database"
+	"cas-to-oauth2/internal/utils"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// proxyCallbackClient sends the proxy granting tickets to the pgtUrl of the proxies.
+var proxyCallbackClient = &http.Client{Timeout: 10 * time.Second}
+
+// grantProxyTicket issues a proxy granting ticket for the user of the validated ticket and sends it,
+// with its IOU, to the pgtUrl callback of the proxy. It returns the IOU, or an empty string when the
+// callback is not an allowed HTTPS URL or did not answer 200: the validation succeeds anyway,
+// without a proxy granting ticket, as the CAS protocol requires.
+// A proxy ticket keeps its chain of proxies in the new proxy granting ticket.
+func grantProxyTicket(ctx context.Context, pgtURL string, ticket *validatedTicket) string {
+	callbackURL, err := url.Parse(pgtURL)
+	if err != nil || callbackURL.Scheme != "https" || !checkAllowedDomains(pgtURL) {
+		log.Printf("Not issuing a proxy granting ticket to callback %s: not an allowed HTTPS URL", pgtURL)
+		return ""
+	}
+
+	pgt, err := utils.GeneratePGT(config.AppConfig.TGTDuration, &database.ProxyGrantingTicket{
+		Service:    pgtURL,
+		Username:   ticket.Username,
+		Attributes: ticket.Attributes,
+		Proxies:    ticket.Proxies,
+	})
+	if err != nil {
+		log.Printf("Error storing proxy granting ticket: %v", err)
+		return ""
+	}
+
+	pgtIOU := utils.GeneratePGTIOU()
+	if err := sendProxyTicket(ctx, callbackURL, pgt, pgtIOU); err != nil {
+		log.Printf("Error sending proxy granting ticket to %s: %v", pgtURL, err)
+		if err := utils.DeletePGT(pgt); err != nil {
+			log.Printf("Error deleting proxy granting ticket: %v", err)
+		}
+		return ""
+	}
+
+	return pgtIOU
+}
+
+func sendProxyTicket(ctx context.Context, callbackURL *url.URL, pgt, pgtIOU string) error {
+	query := callbackURL.Query()
+	query.Set(constants.VALIDATE_PGT_ID_PARAM, pgt)
+	query.Set(constants.VALIDATE_PGT_IOU_PARAM, pgtIOU)
+	callbackURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, callbackURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := proxyCallbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(constants.VALIDATE_ERRMSG_PGT_CALLBACK, resp.StatusCode)
+	}
+	return nil
+}
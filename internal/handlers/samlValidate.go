@@ -5,6 +5,7 @@ import (
 	"cas-to-oauth2/constants"
 	"cas-to-oauth2/internal/utils"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -32,7 +33,12 @@ func SamlValidate(c *gin.Context) {
 		return
 	}
 
-	isValid, username, _, isOk := validationSAML(c, samlRequest.Body.Request.AssertionArtifact, serviceUrl)
+	isValid, username, _, isOk, err := validationSAML(c, samlRequest.Body.Request.AssertionArtifact, serviceUrl)
+	if err != nil {
+		samlResponseError(c, constants.SAML_ERRMSG_INTERNAL)
+		return
+	}
+
 	if !isOk {
 		samlResponseError(c, constants.SAML_ERRMSG_VALIDATION)
 		return
@@ -46,7 +52,7 @@ func SamlValidate(c *gin.Context) {
 	samlResponseSuccess(c, serviceUrl, username)
 }
 
-func validationSAML(c *gin.Context, serviceTicket string, serviceURL string) (bool, string, bool, bool) {
+func validationSAML(c *gin.Context, serviceTicket string, serviceURL string) (bool, string, bool, bool, error) {
 	span, _ := utils.StartAPMSpan(c.Request.Context(), config.AppConfig.UseAPM, utils.GetFunctionName(), "")
 	defer utils.EndAPMSpan(span)
 
@@ -56,18 +62,23 @@ func validationSAML(c *gin.Context, serviceTicket string, serviceURL string) (bo
 	utils.SetAPMLabel(span, constants.COMMON_RENEW_PARAM, renew)
 
 	if serviceTicket == "" || serviceURL == "" {
-		return false, "", false, false
+		return false, "", false, false, nil
+	}
+
+	isValid, ticket, err := utils.ValidateServiceTicket(serviceTicket, serviceURL)
+	if err != nil {
+		log.Printf("Error validating service ticket: %v", err)
+		return false, "", false, true, err
 	}
 
-	isValid, username, isDirect := utils.ValidateServiceTicket(serviceTicket, serviceURL)
-	if !isValid || (utils.IsTrue(renew) && !isDirect) {
-		return false, "", false, true
+	if !isValid || (utils.IsTrue(renew) && !ticket.IsDirect) {
+		return false, "", false, true, nil
 	}
 
 	utils.SetAPMLabel(span, constants.VALIDATE_IS_VALID, isValid)
-	utils.SetAPMLabel(span, constants.VALIDATE_IS_DIRECT, isDirect)
+	utils.SetAPMLabel(span, constants.VALIDATE_IS_DIRECT, ticket.IsDirect)
 
-	return true, username, isDirect, true
+	return true, ticket.Username, ticket.IsDirect, true, nil
 }
 
 func samlResponseError(c *gin.Context, message string) {
@@ -5,7 +5,12 @@ import (
 	"cas-to-oauth2/constants"
 	"cas-to-oauth2/internal/utils"
 	"encoding/xml"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,16 +21,73 @@ import (
 //   - ticket: The service ticket issued by the CAS server.
 //   - service: The URL of the service requesting authentication.
 //   - renew(optional): Indicates whether to force re-authentication, ignoring single sign-on sessions
+//   - pgtUrl(optional): The HTTPS callback URL of a proxy, which receives a proxy granting ticket.
 //
 // Returns:
-//   - An XML response that either confirms the validity of the service ticket
-//     or provides an error message indicating the reason for validation failure.
+//   - An XML response that either confirms the validity of the service ticket, with the PGT IOU
+//     when a proxy granting ticket was issued, or provides an error message indicating the reason for validation failure.
 func ServiceValidate(c *gin.Context) {
+	serviceValidate(c, false, false)
+}
+
+// P3ServiceValidate validates the service ticket provided by the client following the CAS 3.0 protocol.
+// It behaves like ServiceValidate but also releases the user attributes stored with the ticket.
+// Parameters from query string:
+//   - ticket: The service ticket issued by the CAS server.
+//   - service: The URL of the service requesting authentication.
+//   - renew(optional): Indicates whether to force re-authentication, ignoring single sign-on sessions
+//   - pgtUrl(optional): The HTTPS callback URL of a proxy, which receives a proxy granting ticket.
+//
+// Returns:
+//   - An XML response that either confirms the validity of the service ticket along with
+//     the user attributes, or provides an error message indicating the reason for validation failure.
+func P3ServiceValidate(c *gin.Context) {
+	serviceValidate(c, true, false)
+}
+
+// ProxyValidate validates a service ticket or a proxy ticket provided by the client.
+// It behaves like ServiceValidate and, for proxy tickets, also lists the proxies the ticket went through,
+// the most recent first.
+// Parameters from query string:
+//   - ticket: The service or proxy ticket issued by the CAS server.
+//   - service: The URL of the service requesting authentication.
+//   - renew(optional): Indicates whether to force re-authentication, proxy tickets are then never accepted.
+//   - pgtUrl(optional): The HTTPS callback URL of a proxy, which receives a proxy granting ticket.
+//
+// Returns:
+//   - An XML response that either confirms the validity of the ticket along with its proxies,
+//     or provides an error message indicating the reason for validation failure.
+func ProxyValidate(c *gin.Context) {
+	serviceValidate(c, false, true)
+}
+
+// P3ProxyValidate validates a service ticket or a proxy ticket following the CAS 3.0 protocol.
+// It behaves like ProxyValidate but also releases the user attributes stored with the ticket.
+// Parameters from query string:
+//   - ticket: The service or proxy ticket issued by the CAS server.
+//   - service: The URL of the service requesting authentication.
+//   - renew(optional): Indicates whether to force re-authentication, proxy tickets are then never accepted.
+//   - pgtUrl(optional): The HTTPS callback URL of a proxy, which receives a proxy granting ticket.
+//
+// Returns:
+//   - An XML response that either confirms the validity of the ticket along with its proxies and
+//     the user attributes, or provides an error message indicating the reason for validation failure.
+func P3ProxyValidate(c *gin.Context) {
+	serviceValidate(c, true, true)
+}
+
+func serviceValidate(c *gin.Context, releaseAttributes, acceptProxyTickets bool) {
 	var response CASResponse
 	response.XMLNS = constants.XML_CAS_NAMESPACE
 	formatted := true
 
-	isValid, username, _, isOk := commonValidation(c)
+	isValid, ticket, isOk, err := commonValidation(c, acceptProxyTickets)
+	if err != nil {
+		response.Failure = &AuthenticationFailure{Code: constants.VALIDATE_INTERNAL_ERROR, Description: constants.VALIDATE_ERRMSG_INTERNAL_ERROR}
+		xmlResponse(c, http.StatusInternalServerError, response, formatted)
+		return
+	}
+
 	if !isOk {
 		response.Failure = &AuthenticationFailure{Code: constants.VALIDATE_INVALID_REQUEST, Description: constants.VALIDATE_ERRMSG_INVALID_REQUEST}
 		xmlResponse(c, http.StatusOK, response, formatted)
@@ -38,7 +100,13 @@ func ServiceValidate(c *gin.Context) {
 		return
 	}
 
-	response.Success = &AuthenticationSuccess{User: username}
+	response.Success = &AuthenticationSuccess{User: ticket.Username, Proxies: ticket.Proxies}
+	if releaseAttributes {
+		response.Success.Attributes = newCASAttributes(ticket.Attributes)
+	}
+	if pgtURL := c.Query(constants.VALIDATE_PGT_URL_PARAM); pgtURL != "" {
+		response.Success.ProxyGrantingTicket = grantProxyTicket(c.Request.Context(), pgtURL, ticket)
+	}
 	xmlResponse(c, http.StatusOK, response, formatted)
 }
 
@@ -53,7 +121,12 @@ func ServiceValidate(c *gin.Context) {
 //   - A plain text response that either confirms the validity of the service ticket
 //     or provides an error message indicating the reason for validation failure.
 func Validate(c *gin.Context) {
-	isValid, username, _, isOk := commonValidation(c)
+	isValid, ticket, isOk, err := commonValidation(c, false)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "no\n")
+		return
+	}
+
 	if !isOk {
 		c.String(http.StatusOK, "no\n")
 		return
@@ -64,10 +137,21 @@ func Validate(c *gin.Context) {
 		return
 	}
 
-	c.String(http.StatusOK, "yes\n%s\n", username)
+	c.String(http.StatusOK, "yes\n%s\n", ticket.Username)
 }
 
-func commonValidation(c *gin.Context) (bool, string, bool, bool) {
+// validatedTicket is the service or proxy ticket accepted by a validation.
+type validatedTicket struct {
+	Username   string
+	Attributes map[string][]string
+	IsDirect   bool
+	Proxies    []string
+}
+
+// commonValidation consumes the service ticket of the request or, when acceptProxyTickets is set,
+// the proxy ticket. It returns whether the ticket is valid, the ticket, whether the request is well
+// formed, and an error when the ticket registry failed.
+func commonValidation(c *gin.Context, acceptProxyTickets bool) (bool, *validatedTicket, bool, error) {
 	span, _ := utils.StartAPMSpan(c.Request.Context(), config.AppConfig.UseAPM, utils.GetFunctionName(), "")
 	defer utils.EndAPMSpan(span)
 
@@ -79,18 +163,83 @@ func commonValidation(c *gin.Context) (bool, string, bool, bool) {
 	utils.SetAPMLabel(span, constants.COMMON_RENEW_PARAM, renew)
 
 	if serviceTicket == "" || serviceURL == "" {
-		return false, "", false, false
+		return false, nil, false, nil
+	}
+
+	isValid, ticket, err := validateTicket(serviceTicket, serviceURL, acceptProxyTickets)
+	if err != nil {
+		log.Printf("Error validating service ticket: %v", err)
+		return false, nil, true, err
 	}
 
-	isValid, username, isDirect := utils.ValidateServiceTicket(serviceTicket, serviceURL)
-	if !isValid || (utils.IsTrue(renew) && !isDirect) {
-		return false, "", false, true
+	if !isValid || (utils.IsTrue(renew) && !ticket.IsDirect) {
+		return false, nil, true, nil
 	}
 
 	utils.SetAPMLabel(span, constants.VALIDATE_IS_VALID, isValid)
-	utils.SetAPMLabel(span, constants.VALIDATE_IS_DIRECT, isDirect)
+	utils.SetAPMLabel(span, constants.VALIDATE_IS_DIRECT, ticket.IsDirect)
+
+	return true, ticket, true, nil
+}
 
-	return true, username, isDirect, true
+// validateTicket consumes a proxy ticket, recognized by its prefix, when proxy tickets are accepted,
+// and a service ticket otherwise.
+func validateTicket(ticket, serviceURL string, acceptProxyTickets bool) (bool, *validatedTicket, error) {
+	if acceptProxyTickets && strings.HasPrefix(ticket, constants.VALIDATE_PROXY_TICKET_PREFIX) {
+		isValid, proxyTicket, err := utils.ValidateProxyTicket(ticket, serviceURL)
+		if !isValid {
+			return false, nil, err
+		}
+		return true, &validatedTicket{
+			Username:   proxyTicket.Username,
+			Attributes: proxyTicket.Attributes,
+			Proxies:    proxyTicket.Proxies,
+		}, nil
+	}
+
+	isValid, serviceTicket, err := utils.ValidateServiceTicket(ticket, serviceURL)
+	if !isValid {
+		return false, nil, err
+	}
+	return true, &validatedTicket{
+		Username:   serviceTicket.Username,
+		Attributes: serviceTicket.Attributes,
+		IsDirect:   serviceTicket.IsDirect,
+	}, nil
+}
+
+func newCASAttributes(attributes map[string][]string) *CASAttributes {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	var casAttributes CASAttributes
+	for _, name := range utils.SortedAttributeNames(attributes) {
+		for _, value := range attributes[name] {
+			casAttributes.Values = append(casAttributes.Values, CASAttribute{
+				XMLName: xml.Name{Local: fmt.Sprintf("%s:%s", constants.XML_CAS_PREFIX, attributeElementName(name))},
+				Value:   value,
+			})
+		}
+	}
+
+	return &casAttributes
+}
+
+// attributeElementName replaces the characters of a claim name that are not allowed in an XML element name.
+// Names that do not start with a letter or _, such as 2fa or -id, are prefixed with _.
+func attributeElementName(name string) string {
+	elementName := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if first, _ := utf8.DecodeRuneInString(elementName); !unicode.IsLetter(first) && first != '_' {
+		elementName = "_" + elementName
+	}
+	return elementName
 }
 
 func xmlResponse(c *gin.Context, code int, response interface{}, formatted bool) {
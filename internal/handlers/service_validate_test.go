@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"cas-to-oauth2/config"
+	"cas-to-oauth2/internal/utils"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// proxyCallback is the pgtUrl of a fake proxy, it records the tickets it receives.
+type proxyCallback struct {
+	*httptest.Server
+
+	mutex  sync.Mutex
+	status int
+	pgtID  string
+	pgtIOU string
+}
+
+func newProxyCallback(t *testing.T, status int) *proxyCallback {
+	callback := &proxyCallback{status: status}
+	callback.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callback.mutex.Lock()
+		defer callback.mutex.Unlock()
+
+		callback.pgtID = r.URL.Query().Get("pgtId")
+		callback.pgtIOU = r.URL.Query().Get("pgtIou")
+		w.WriteHeader(callback.status)
+	}))
+	t.Cleanup(callback.Close)
+
+	client := proxyCallbackClient
+	proxyCallbackClient = callback.Client()
+	t.Cleanup(func() { proxyCallbackClient = client })
+	return callback
+}
+
+func (p *proxyCallback) tickets() (string, string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pgtID, p.pgtIOU
+}
+
+// casResponse reads the CAS responses, whose element names are written with the cas: prefix.
+type casResponse struct {
+	Success *struct {
+		User                string   `xml:"user"`
+		ProxyGrantingTicket string   `xml:"proxyGrantingTicket"`
+		Mail                string   `xml:"attributes>mail"`
+		Proxies             []string `xml:"proxies>proxy"`
+	} `xml:"authenticationSuccess"`
+	Failure *struct {
+		Code string `xml:"code,attr"`
+	} `xml:"authenticationFailure"`
+	ProxySuccess *struct {
+		ProxyTicket string `xml:"proxyTicket"`
+	} `xml:"proxySuccess"`
+}
+
+func parseCASResponse(t *testing.T, recorder *httptest.ResponseRecorder) casResponse {
+	t.Helper()
+	var response casResponse
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %s: %v", recorder.Body.String(), err)
+	}
+	return response
+}
+
+// validateServiceTicket issues a service ticket for jdoe and validates it with the given pgtUrl.
+func validateServiceTicket(t *testing.T, pgtURL string) casResponse {
+	t.Helper()
+	const service = "https://service.example.edu/app"
+
+	st, err := utils.GenerateServiceTicket(service, "jdoe", map[string][]string{"mail": {"jdoe@example.edu"}}, "TGT-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{"ticket": {st}, "service": {service}}
+	if pgtURL != "" {
+		query.Set("pgtUrl", pgtURL)
+	}
+	c, recorder := newContext(httptest.NewRequest(http.MethodGet, "/serviceValidate?"+query.Encode(), nil))
+	ServiceValidate(c)
+
+	response := parseCASResponse(t, recorder)
+	if response.Success == nil || response.Success.User != "jdoe" {
+		t.Fatalf("service ticket not validated: %s", recorder.Body.String())
+	}
+	return response
+}
+
+func requestProxyTicket(pgt string) *httptest.ResponseRecorder {
+	query := url.Values{"pgt": {pgt}, "targetService": {"https://backend.example.edu/api"}}
+	c, recorder := newContext(httptest.NewRequest(http.MethodGet, "/proxy?"+query.Encode(), nil))
+	Proxy(c)
+	return recorder
+}
+
+func TestServiceValidateIssuesProxyGrantingTicket(t *testing.T) {
+	setupConfig(t)
+	setupRegistry(t)
+	callback := newProxyCallback(t, http.StatusOK)
+	callbackURL, _ := url.Parse(callback.URL)
+	config.AppConfig.AllowedDomains = []string{"service.example.edu", callbackURL.Hostname()}
+
+	response := validateServiceTicket(t, callback.URL+"/pgtCallback")
+
+	pgtID, pgtIOU := callback.tickets()
+	if !strings.HasPrefix(pgtID, "PGT-") || !strings.HasPrefix(pgtIOU, "PGTIOU-") {
+		t.Fatalf("callback received pgtId %q and pgtIou %q", pgtID, pgtIOU)
+	}
+	if response.Success.ProxyGrantingTicket != pgtIOU {
+		t.Fatalf("response has PGT IOU %q, want %q", response.Success.ProxyGrantingTicket, pgtIOU)
+	}
+
+	// The proxy gets proxy tickets for the user with the PGT
+	recorder := requestProxyTicket(pgtID)
+	proxyResponse := parseCASResponse(t, recorder)
+	if proxyResponse.ProxySuccess == nil {
+		t.Fatalf("no proxy ticket issued: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	isValid, ticket, err := utils.ValidateProxyTicket(proxyResponse.ProxySuccess.ProxyTicket, "https://backend.example.edu/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isValid || ticket.Username != "jdoe" || len(ticket.Proxies) != 1 || ticket.Proxies[0] != callback.URL+"/pgtCallback" {
+		t.Fatalf("proxy ticket %+v not valid for jdoe through the callback", ticket)
+	}
+}
+
+// validateProxyTicket validates the ticket for the backend service with one of the validation handlers.
+func validateProxyTicket(t *testing.T, handler func(c *gin.Context), ticket string, renew bool) casResponse {
+	t.Helper()
+	query := url.Values{"ticket": {ticket}, "service": {"https://backend.example.edu/api"}}
+	if renew {
+		query.Set("renew", "true")
+	}
+	c, recorder := newContext(httptest.NewRequest(http.MethodGet, "/p3/proxyValidate?"+query.Encode(), nil))
+	handler(c)
+	return parseCASResponse(t, recorder)
+}
+
+// issueProxyTicket runs the proxy flow: the service ticket is validated on /p3/serviceValidate with a
+// pgtUrl, and the PGT sent to the callback is used on /proxy to get a proxy ticket for the backend.
+func issueProxyTicket(t *testing.T) (string, string) {
+	t.Helper()
+	const service = "https://service.example.edu/app"
+	callback := newProxyCallback(t, http.StatusOK)
+	callbackURL, _ := url.Parse(callback.URL)
+	config.AppConfig.AllowedDomains = []string{"service.example.edu", "backend.example.edu", callbackURL.Hostname()}
+	pgtURL := callback.URL + "/pgtCallback"
+
+	st, err := utils.GenerateServiceTicket(service, "jdoe", map[string][]string{"mail": {"jdoe@example.edu"}}, "TGT-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"ticket": {st}, "service": {service}, "pgtUrl": {pgtURL}}
+	c, recorder := newContext(httptest.NewRequest(http.MethodGet, "/p3/serviceValidate?"+query.Encode(), nil))
+	P3ServiceValidate(c)
+	if response := parseCASResponse(t, recorder); response.Success == nil || response.Success.ProxyGrantingTicket == "" {
+		t.Fatalf("no PGT issued: %s", recorder.Body.String())
+	}
+
+	pgtID, _ := callback.tickets()
+	recorder = requestProxyTicket(pgtID)
+	response := parseCASResponse(t, recorder)
+	if response.ProxySuccess == nil {
+		t.Fatalf("no proxy ticket issued: %d %s", recorder.Code, recorder.Body.String())
+	}
+	return response.ProxySuccess.ProxyTicket, pgtURL
+}
+
+func TestP3ProxyValidate(t *testing.T) {
+	setupConfig(t)
+	setupRegistry(t)
+	pt, pgtURL := issueProxyTicket(t)
+
+	response := validateProxyTicket(t, P3ProxyValidate, pt, false)
+	if response.Success == nil || response.Success.User != "jdoe" || response.Success.Mail != "jdoe@example.edu" {
+		t.Fatalf("proxy ticket not validated with the attributes: %+v", response.Success)
+	}
+	if len(response.Success.Proxies) != 1 || response.Success.Proxies[0] != pgtURL {
+		t.Fatalf("proxies are %v, want [%s]", response.Success.Proxies, pgtURL)
+	}
+
+	// The proxy ticket is valid once
+	if response := validateProxyTicket(t, P3ProxyValidate, pt, false); response.Failure == nil || response.Failure.Code != "INVALID_TICKET" {
+		t.Fatalf("proxy ticket validated twice: %+v", response)
+	}
+}
+
+func TestProxyValidate(t *testing.T) {
+	setupConfig(t)
+	setupRegistry(t)
+	pt, pgtURL := issueProxyTicket(t)
+
+	response := validateProxyTicket(t, ProxyValidate, pt, false)
+	if response.Success == nil || response.Success.User != "jdoe" || response.Success.Mail != "" {
+		t.Fatalf("proxy ticket not validated without the attributes: %+v", response.Success)
+	}
+	if len(response.Success.Proxies) != 1 || response.Success.Proxies[0] != pgtURL {
+		t.Fatalf("proxies are %v, want [%s]", response.Success.Proxies, pgtURL)
+	}
+
+	// A service ticket is accepted too, without proxies
+	st, err := utils.GenerateServiceTicket("https://backend.example.edu/api", "jdoe", nil, "TGT-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := validateProxyTicket(t, ProxyValidate, st, false); response.Success == nil || len(response.Success.Proxies) != 0 {
+		t.Fatalf("service ticket not validated without proxies: %+v", response.Success)
+	}
+}
+
+func TestProxyTicketRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(c *gin.Context)
+		renew   bool
+	}{
+		{"serviceValidate", ServiceValidate, false},
+		{"p3/serviceValidate", P3ServiceValidate, false},
+		{"proxyValidate with renew", ProxyValidate, true},
+		{"p3/proxyValidate with renew", P3ProxyValidate, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t)
+			setupRegistry(t)
+			pt, _ := issueProxyTicket(t)
+
+			if response := validateProxyTicket(t, tt.handler, pt, tt.renew); response.Success != nil {
+				t.Fatalf("proxy ticket accepted: %+v", response.Success)
+			}
+		})
+	}
+}
+
+func TestServiceValidateWithoutProxyGrantingTicket(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		scheme   string
+		allowed  bool
+		wantCall bool
+	}{
+		{"callback answering an error", http.StatusNotFound, "https", true, true},
+		{"callback over plain HTTP", http.StatusOK, "http", true, false},
+		{"callback of a domain not allowed", http.StatusOK, "https", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t)
+			setupRegistry(t)
+			callback := newProxyCallback(t, tt.status)
+			callbackURL, _ := url.Parse(callback.URL)
+			if tt.allowed {
+				config.AppConfig.AllowedDomains = []string{"service.example.edu", callbackURL.Hostname()}
+			}
+			callbackURL.Scheme = tt.scheme
+
+			// The service ticket is still valid, only the PGT is missing
+			response := validateServiceTicket(t, callbackURL.String())
+			if response.Success.ProxyGrantingTicket != "" {
+				t.Fatalf("got PGT IOU %q", response.Success.ProxyGrantingTicket)
+			}
+
+			pgtID, _ := callback.tickets()
+			if (pgtID != "") != tt.wantCall {
+				t.Fatalf("callback received pgtId %q", pgtID)
+			}
+			if pgtID == "" {
+				return
+			}
+
+			// The PGT sent to a failed callback is not usable
+			if recorder := requestProxyTicket(pgtID); recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), "BAD_PGT") {
+				t.Fatalf("PGT of a failed callback accepted: %d %s", recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestServiceValidateWithoutPgtURL(t *testing.T) {
+	setupConfig(t)
+	setupRegistry(t)
+
+	if response := validateServiceTicket(t, ""); response.Success.ProxyGrantingTicket != "" {
+		t.Fatalf("got PGT IOU %q without pgtUrl", response.Success.ProxyGrantingTicket)
+	}
+}
+
+func TestAttributeElementName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"mail", "mail"},
+		{"given_name", "given_name"},
+		{"_id", "_id"},
+		{"eduPerson.affiliation-1", "eduPerson.affiliation-1"},
+		{"ñandú", "ñandú"},
+		{"2fa", "_2fa"},
+		{"-id", "_-id"},
+		{".hidden", "_.hidden"},
+		{"urn:oid:0.9.2342.19200300.100.1.3", "urn_oid_0.9.2342.19200300.100.1.3"},
+		{"https://example.edu/claims/groups", "https___example.edu_claims_groups"},
+		{"", "_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attributeElementName(tt.name); got != tt.want {
+				t.Fatalf("attributeElementName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCASAttributesAreWellFormed(t *testing.T) {
+	attributes := map[string][]string{
+		"2fa":     {"true"},
+		"-id":     {"1234"},
+		".hidden": {"x"},
+		"a b<c>":  {"<script>"},
+		"mail":    {"jdoe@example.edu"},
+	}
+
+	data, err := xml.Marshal(newCASAttributes(attributes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var values []string
+	decoder := xml.NewDecoder(strings.NewReader(string(data)))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("invalid XML %s: %v", data, err)
+			}
+			break
+		}
+		if element, ok := token.(xml.StartElement); ok && element.Name.Space == "cas" {
+			values = append(values, element.Name.Local)
+		}
+	}
+
+	want := []string{"_-id", "_.hidden", "_2fa", "a_b_c_", "mail"}
+	if strings.Join(values, " ") != strings.Join(want, " ") {
+		t.Fatalf("elements = %v, want %v", values, want)
+	}
+}
@@ -4,42 +4,83 @@ import (
 	"cas-to-oauth2/constants"
 	"cas-to-oauth2/database"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"time"
 
-	"github.com/dgrijalva/jwt-go/v4"
 	"github.com/gorilla/securecookie"
-	"golang.org/x/oauth2"
+	"golang.org/x/crypto/hkdf"
 )
 
 var (
 	ticketExpiration          = 5 * time.Minute
 	executionExpiration       = 1 * time.Minute
 	executionCounter    int32 = 0
-)
 
-func GetSubjectFromToken(token *oauth2.Token) (string, error) {
-	rawIDToken, ok := token.Extra(constants.UTILS_ID_TOKEN).(string)
-	if !ok {
-		return "", fmt.Errorf(constants.UTILS_ERRMSG_MISSING)
+	// protocolClaims are ID token claims that describe the token itself and
+	// are never released to CAS services as user attributes.
+	protocolClaims = map[string]bool{
+		"iss": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+		"nonce": true, "azp": true, "at_hash": true, "c_hash": true, "sid": true, "auth_time": true,
 	}
+)
 
-	parsedToken, _, err := new(jwt.Parser).ParseUnverified(rawIDToken, jwt.MapClaims{})
-	if err != nil {
-		return "", err
+// GetAttributesFromClaims converts token claims into multi-valued CAS attributes.
+// Arrays become one value per element and nested objects are kept as JSON.
+func GetAttributesFromClaims(claims map[string]interface{}) map[string][]string {
+	attributes := make(map[string][]string)
+	for name, value := range claims {
+		if protocolClaims[name] || value == nil {
+			continue
+		}
+
+		var values []string
+		if list, ok := value.([]interface{}); ok {
+			for _, item := range list {
+				values = append(values, claimToString(item))
+			}
+		} else {
+			values = []string{claimToString(value)}
+		}
+
+		if len(values) > 0 {
+			attributes[name] = values
+		}
 	}
 
-	claims, ok := parsedToken.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", fmt.Errorf(constants.UTILS_ERRMSG_CLAIM_PARSE)
+	return attributes
+}
+
+// SortedAttributeNames returns the attribute names in a stable order for rendering.
+func SortedAttributeNames(attributes map[string][]string) []string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	sub, ok := claims[constants.UTILS_CLAIM].(string)
-	if !ok {
-		return "", fmt.Errorf(constants.UTILS_ERRMSG_CLAIM_NOT_EXIST)
+func claimToString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
 	}
-	return sub, nil
 }
 
 func RandomString(n int) string {
@@ -48,48 +89,124 @@ func RandomString(n int) string {
 	return hex.EncodeToString(bytes)
 }
 
-func GenerateServiceTicket(service, username, tgt string, isDirect bool) string {
+// GenerateServiceTicket stores a new service ticket and returns it. No ticket is returned when it could not be stored.
+func GenerateServiceTicket(service, username string, attributes map[string][]string, tgt string, isDirect bool) (string, error) {
 	st := fmt.Sprintf("ST-%s", RandomString(32))
 	expiration := time.Now().Add(ticketExpiration)
-	database.Conn.GenerateServiceTicket(st, service, username, isDirect, expiration)
-	return st
+	err := database.Registry.CreateServiceTicket(&database.ServiceTicket{
+		Ticket:     st,
+		Service:    service,
+		Username:   username,
+		Attributes: attributes,
+		IsDirect:   isDirect,
+		Expires:    expiration,
+	})
+	if err != nil {
+		return "", err
+	}
+	return st, nil
 }
 
-func GenerateTGT(expire int, username string) string {
-	tgt := fmt.Sprintf("TGT-%s", RandomString(32))
+// GenerateTGT stores the session with a new ticket and expiration and returns the ticket.
+func GenerateTGT(expire int, session *database.TicketGrantingTicket) (string, error) {
+	session.TGT = fmt.Sprintf("TGT-%s", RandomString(32))
 	timeMins := time.Duration(expire) * time.Minute
-	expiration := time.Now().Add(timeMins)
-	database.Conn.GenerateTGT(tgt, username, expiration)
-	return tgt
+	session.Expires = time.Now().Add(timeMins)
+	if err := database.Registry.CreateTGT(session); err != nil {
+		return "", err
+	}
+	return session.TGT, nil
+}
+
+// GeneratePGT stores a proxy granting ticket with a new ID, valid for expire minutes like a TGT.
+func GeneratePGT(expire int, ticket *database.ProxyGrantingTicket) (string, error) {
+	ticket.PGT = fmt.Sprintf("PGT-%s", RandomString(32))
+	ticket.Expires = time.Now().Add(time.Duration(expire) * time.Minute)
+	if err := database.Registry.CreatePGT(ticket); err != nil {
+		return "", err
+	}
+	return ticket.PGT, nil
+}
+
+// GeneratePGTIOU returns the identifier a proxy receives with its PGT and finds in the validation response.
+func GeneratePGTIOU() string {
+	return fmt.Sprintf("PGTIOU-%s", RandomString(32))
+}
+
+func DeletePGT(pgt string) error {
+	return database.Registry.DeletePGT(pgt)
 }
 
-func GenerateProxyTicket(service, pgt string) string {
-	pt := fmt.Sprintf("PT-%s", RandomString(32))
-	// expiration := time.Now().Add(ticketExpiration)
-	// database.Conn.GenerateProxyTicket(pt, service, pgt, expiration)
-	return pt
+// GenerateProxyTicket issues a proxy ticket for the target service on behalf of the user of the PGT.
+// It fails with database.ErrTicketNotFound when the PGT is not valid.
+func GenerateProxyTicket(pgt, service string) (string, error) {
+	proxyGrantingTicket, err := database.Registry.ValidatePGT(pgt)
+	if err != nil {
+		return "", err
+	}
+
+	pt := constants.VALIDATE_PROXY_TICKET_PREFIX + RandomString(32)
+	err = database.Registry.CreateProxyTicket(&database.ProxyTicket{
+		Ticket:     pt,
+		Service:    service,
+		Username:   proxyGrantingTicket.Username,
+		Attributes: proxyGrantingTicket.Attributes,
+		PGT:        pgt,
+		Proxies:    append([]string{proxyGrantingTicket.Service}, proxyGrantingTicket.Proxies...),
+		Expires:    time.Now().Add(ticketExpiration),
+	})
+	if err != nil {
+		return "", err
+	}
+	return pt, nil
 }
 
-func ValidateServiceTicket(st, service string) (bool, string, bool) {
-	return database.Conn.ValidateServiceTicket(st, service)
+// ValidateServiceTicket consumes the service ticket. An unknown ticket is not valid, while
+// the error reports a failure of the ticket registry.
+func ValidateServiceTicket(st, service string) (bool, *database.ServiceTicket, error) {
+	ticket, err := database.Registry.ConsumeServiceTicket(st, service)
+	if errors.Is(err, database.ErrTicketNotFound) {
+		return false, nil, nil
+	}
+	return err == nil, ticket, err
 }
 
-func ValidateTGT(tgt string) (bool, string) {
-	return database.Conn.ValidateTGT(tgt)
+// ValidateTGT looks up the TGT, with the same results as ValidateServiceTicket.
+func ValidateTGT(tgt string) (bool, *database.TicketGrantingTicket, error) {
+	ticket, err := database.Registry.ValidateTGT(tgt)
+	if errors.Is(err, database.ErrTicketNotFound) {
+		return false, nil, nil
+	}
+	return err == nil, ticket, err
 }
 
 func ValidatePGT(pgt string) (bool, error) {
-	//return database.Conn.ValidatePGT(pgt)
-	return true, nil
+	_, err := database.Registry.ValidatePGT(pgt)
+	if errors.Is(err, database.ErrTicketNotFound) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-func ValidateProxyTicket(pt, service string) (string, string, []string, error) {
-	//return database.Conn.ValidateProxyTicket(pt, service)
-	return "", "", nil, nil
+// ValidateProxyTicket consumes the proxy ticket, with the same results as ValidateServiceTicket.
+func ValidateProxyTicket(pt, service string) (bool, *database.ProxyTicket, error) {
+	ticket, err := database.Registry.ConsumeProxyTicket(pt, service)
+	if errors.Is(err, database.ErrTicketNotFound) {
+		return false, nil, nil
+	}
+	return err == nil, ticket, err
 }
 
 func DeleteTGT(tgt string) error {
-	return database.Conn.DeleteTGT(tgt)
+	return database.Registry.DeleteTGT(tgt)
+}
+
+func UpdateTGTRefresh(tgt, refreshToken string, refreshedAt time.Time) error {
+	return database.Registry.UpdateTGTRefresh(tgt, refreshToken, refreshedAt)
+}
+
+func DeleteTGTsBySession(provider, sub, sid string) (int64, error) {
+	return database.Registry.DeleteTGTsBySession(provider, sub, sid)
 }
 
 func IsTrue(s string) bool {
@@ -104,6 +221,39 @@ func Encrypt(secureCookie *securecookie.SecureCookie, value string) (string, err
 	return encoded, nil
 }
 
+// NewTokenCipher returns the codec of the refresh tokens stored with the TGTs. Its keys are derived with
+// HKDF from the cookie keys under their own labels, so a cookie can not be read as a token or the other way round.
+// Tokens do not expire with the codec, they live as long as their TGT.
+func NewTokenCipher(hashKey, blockKey []byte) (*securecookie.SecureCookie, error) {
+	tokenHashKey, err := deriveKey(hashKey, constants.TOKEN_CIPHER_HASH_LABEL, 64)
+	if err != nil {
+		return nil, err
+	}
+	tokenBlockKey, err := deriveKey(blockKey, constants.TOKEN_CIPHER_BLOCK_LABEL, 32)
+	if err != nil {
+		return nil, err
+	}
+	return securecookie.New(tokenHashKey, tokenBlockKey).MaxAge(0), nil
+}
+
+func deriveKey(secret []byte, label string, length int) ([]byte, error) {
+	key := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(label)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EncodeCookie signs and encrypts any value so it can be stored in the named cookie.
+func EncodeCookie(secureCookie *securecookie.SecureCookie, name string, value interface{}) (string, error) {
+	return secureCookie.Encode(name, value)
+}
+
+// DecodeCookie verifies and decrypts a value stored with EncodeCookie into dst.
+func DecodeCookie(secureCookie *securecookie.SecureCookie, name, value string, dst interface{}) error {
+	return secureCookie.Decode(name, value, dst)
+}
+
 func Decrypt(secureCookie *securecookie.SecureCookie, value string) (string, error) {
 	var decoded string
 	err := secureCookie.Decode(constants.SERVICE_URL_COOKIE, value, &decoded)
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"cas-to-oauth2/constants"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestTokenCipher(t *testing.T) {
+	hashKey := []byte("0123456789abcdef0123456789abcdef")
+	blockKey := []byte("fedcba9876543210fedcba9876543210")
+
+	cipher, err := NewTokenCipher(hashKey, blockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := EncodeCookie(cipher, constants.REFRESH_TOKEN_NAME, "refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "refresh-token") {
+		t.Fatal("refresh token stored in clear text")
+	}
+
+	var refreshToken string
+	if err := DecodeCookie(cipher, constants.REFRESH_TOKEN_NAME, encrypted, &refreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if refreshToken != "refresh-token" {
+		t.Fatalf("got %q, want refresh-token", refreshToken)
+	}
+
+	// The same keys give the same cipher, so tokens survive restarts and are shared by every node
+	restarted, err := NewTokenCipher(hashKey, blockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeCookie(restarted, constants.REFRESH_TOKEN_NAME, encrypted, &refreshToken); err != nil {
+		t.Fatalf("token not readable with the same keys: %v", err)
+	}
+
+	tampered := []byte(encrypted)
+	tampered[len(tampered)/2] ^= 1
+	if err := DecodeCookie(cipher, constants.REFRESH_TOKEN_NAME, string(tampered), &refreshToken); err == nil {
+		t.Fatal("tampered token accepted")
+	}
+
+	// The cookie codec uses the keys as they are and can not read the tokens
+	cookieCodec := securecookie.New(hashKey, blockKey)
+	if err := DecodeCookie(cookieCodec, constants.REFRESH_TOKEN_NAME, encrypted, &refreshToken); err == nil {
+		t.Fatal("token readable with the cookie keys")
+	}
+	cookie, err := EncodeCookie(cookieCodec, constants.REFRESH_TOKEN_NAME, "refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeCookie(cipher, constants.REFRESH_TOKEN_NAME, cookie, &refreshToken); err == nil {
+		t.Fatal("cookie readable as a token")
+	}
+}